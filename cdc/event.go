@@ -0,0 +1,95 @@
+package cdc
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+)
+
+// Op is the kind of a row change
+type Op string
+
+const (
+	OpInsert Op = "insert"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// Change is one row change to the users table
+type Change struct {
+	Op Op
+
+	// User is the row after the change; for deletes it is the deleted row
+	User *models.User
+
+	// Old is the row before an update; nil for inserts and deletes
+	Old *models.User
+}
+
+// Event holds the changes a committed transaction made to the users table of one shard
+type Event struct {
+	ShardID int
+
+	// LSN is the end of the transaction's commit record; pass it to Ack once the event is handled
+	LSN        LSN
+	CommitTime time.Time
+	Changes    []Change
+}
+
+// timestampLayout is how PostgreSQL prints TIMESTAMP values with the default ISO DateStyle
+const timestampLayout = "2006-01-02 15:04:05.999999999"
+
+// change converts a decoded users row change into its typed form
+func (m *changeMessage) change() (Change, error) {
+	c := Change{Op: m.op}
+
+	row := m.new
+	if m.op == OpDelete {
+		row = m.old
+	}
+	user, err := row.user()
+	if err != nil {
+		return c, err
+	}
+	c.User = user
+
+	if m.op == OpUpdate && m.old != nil {
+		if c.Old, err = m.old.user(); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
+
+// user reads the users columns present in the tuple
+func (t tuple) user() (*models.User, error) {
+	u := &models.User{}
+	for column, value := range t {
+		if value == nil {
+			continue
+		}
+
+		var err error
+		switch column {
+		case "id":
+			u.ID, err = strconv.ParseInt(*value, 10, 64)
+		case "user_id":
+			u.UserID = *value
+		case "name":
+			u.Name = *value
+		case "email":
+			u.Email = *value
+		case "created_at":
+			u.CreatedAt, err = time.Parse(timestampLayout, *value)
+		case "version":
+			u.Version, err = strconv.ParseInt(*value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid users.%s value %q: %w", column, *value, err)
+		}
+	}
+	return u, nil
+}
@@ -0,0 +1,21 @@
+package cdc
+
+import (
+	"fmt"
+)
+
+// LSN is a position in a shard's write-ahead log
+type LSN uint64
+
+// ParseLSN parses the textual form PostgreSQL uses, such as "16/B374D848"
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	return LSN(uint64(hi)<<32 | uint64(lo)), nil
+}
+
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
+}
@@ -0,0 +1,233 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pgoutput message types (protocol version 1)
+const (
+	msgBegin    = 'B'
+	msgCommit   = 'C'
+	msgRelation = 'R'
+	msgInsert   = 'I'
+	msgUpdate   = 'U'
+	msgDelete   = 'D'
+)
+
+// pgEpoch is the origin of the timestamps in the replication protocol
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var errShortMessage = errors.New("message too short")
+
+// relation describes a published table; the server sends it before the table's first change
+type relation struct {
+	namespace string
+	name      string
+	columns   []string
+}
+
+// tuple holds a row's text values by column name; nil is SQL NULL
+// Unchanged TOASTed values are left out.
+type tuple map[string]*string
+
+type beginMessage struct {
+	finalLSN   LSN
+	commitTime time.Time
+	xid        uint32
+}
+
+type commitMessage struct {
+	commitLSN  LSN
+	endLSN     LSN
+	commitTime time.Time
+}
+
+type changeMessage struct {
+	op  Op
+	rel *relation
+	old tuple
+	new tuple
+}
+
+// decoder parses pgoutput messages, keeping the relations the server has described
+type decoder struct {
+	relations map[uint32]*relation
+}
+
+func newDecoder() *decoder {
+	return &decoder{relations: make(map[uint32]*relation)}
+}
+
+// decode parses one pgoutput message
+// Relations are recorded and return nil, as do message types the subscriber
+// doesn't use (types, origins, truncates and logical messages).
+func (d *decoder) decode(data []byte) (any, error) {
+	if len(data) == 0 {
+		return nil, errShortMessage
+	}
+	r := &reader{buf: data[1:]}
+
+	var msg any
+	switch data[0] {
+	case msgBegin:
+		msg = &beginMessage{finalLSN: LSN(r.uint64()), commitTime: r.time(), xid: r.uint32()}
+	case msgCommit:
+		r.byte() // flags, unused
+		msg = &commitMessage{commitLSN: LSN(r.uint64()), endLSN: LSN(r.uint64()), commitTime: r.time()}
+	case msgRelation:
+		d.decodeRelation(r)
+	case msgInsert, msgUpdate, msgDelete:
+		change, err := d.decodeChange(data[0], r)
+		if err != nil {
+			return nil, err
+		}
+		msg = change
+	}
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to decode %q message: %w", data[0], r.err)
+	}
+	return msg, nil
+}
+
+func (d *decoder) decodeRelation(r *reader) {
+	id := r.uint32()
+	rel := &relation{namespace: r.cstring(), name: r.cstring()}
+	r.byte() // replica identity setting
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		r.byte() // flags
+		rel.columns = append(rel.columns, r.cstring())
+		r.uint32() // type OID
+		r.uint32() // type modifier
+	}
+	if r.err == nil {
+		d.relations[id] = rel
+	}
+}
+
+func (d *decoder) decodeChange(kind byte, r *reader) (*changeMessage, error) {
+	id := r.uint32()
+	if r.err != nil {
+		return nil, nil
+	}
+	rel, ok := d.relations[id]
+	if !ok {
+		return nil, fmt.Errorf("change to unknown relation %d", id)
+	}
+
+	change := &changeMessage{rel: rel}
+	switch kind {
+	case msgInsert:
+		change.op = OpInsert
+		r.byte() // 'N'
+		change.new = r.tuple(rel)
+	case msgUpdate:
+		change.op = OpUpdate
+		// The old row ('O', or just its key, 'K') is only sent when the replica identity includes it
+		if t := r.byte(); t == 'O' || t == 'K' {
+			change.old = r.tuple(rel)
+			r.byte() // 'N'
+		}
+		change.new = r.tuple(rel)
+	case msgDelete:
+		change.op = OpDelete
+		r.byte() // 'O' or 'K'
+		change.old = r.tuple(rel)
+	}
+
+	return change, nil
+}
+
+// reader consumes a message; after the first error every read returns zero values
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errShortMessage
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// time reads microseconds since 2000-01-01 UTC
+func (r *reader) time() time.Time {
+	return pgEpoch.Add(time.Duration(int64(r.uint64())) * time.Microsecond)
+}
+
+func (r *reader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	for i, c := range r.buf {
+		if c == 0 {
+			s := string(r.buf[:i])
+			r.buf = r.buf[i+1:]
+			return s
+		}
+	}
+	r.err = errShortMessage
+	return ""
+}
+
+func (r *reader) tuple(rel *relation) tuple {
+	n := int(r.uint16())
+	if r.err == nil && n > len(rel.columns) {
+		r.err = fmt.Errorf("tuple has %d columns, relation %s has %d", n, rel.name, len(rel.columns))
+	}
+
+	t := make(tuple, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		switch kind := r.byte(); kind {
+		case 'n':
+			t[rel.columns[i]] = nil
+		case 'u':
+			// unchanged TOASTed value, not sent
+		case 't':
+			s := string(r.next(int(r.uint32())))
+			t[rel.columns[i]] = &s
+		default:
+			r.err = fmt.Errorf("unsupported tuple value kind %q", kind)
+		}
+	}
+	return t
+}
@@ -0,0 +1,128 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// message builds pgoutput messages for the decoder tests
+type message []byte
+
+func (m message) byte(b byte) message      { return append(m, b) }
+func (m message) cstring(s string) message { return append(append(m, s...), 0) }
+func (m message) uint16(v uint16) message {
+	return binary.BigEndian.AppendUint16(m, v)
+}
+func (m message) uint32(v uint32) message {
+	return binary.BigEndian.AppendUint32(m, v)
+}
+func (m message) uint64(v uint64) message {
+	return binary.BigEndian.AppendUint64(m, v)
+}
+
+// row appends a tuple; nil values are NULLs
+func (m message) row(values ...*string) message {
+	m = m.uint16(uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			m = m.byte('n')
+			continue
+		}
+		m = m.byte('t').uint32(uint32(len(*v)))
+		m = append(m, *v...)
+	}
+	return m
+}
+
+func str(s string) *string { return &s }
+
+func usersRelation() message {
+	m := message{msgRelation}.uint32(16384).cstring("public").cstring("users").byte('f').uint16(5)
+	for _, column := range []string{"id", "user_id", "name", "email", "created_at"} {
+		m = m.byte(0).cstring(column).uint32(25).uint32(0)
+	}
+	return m
+}
+
+func userRow(name string) []*string {
+	return []*string{str("42"), str("user_1"), str(name), str("user_1@example.com"), str("2025-03-04 05:06:07.123456")}
+}
+
+func TestLSN(t *testing.T) {
+	lsn, err := ParseLSN("16/B374D848")
+	require.NoError(t, err)
+	assert.Equal(t, LSN(0x16B374D848), lsn)
+	assert.Equal(t, "16/B374D848", lsn.String())
+
+	_, err = ParseLSN("nope")
+	assert.Error(t, err)
+}
+
+func TestDecoder_Transaction(t *testing.T) {
+	dec := newDecoder()
+	commitTime := pgEpoch.Add(time.Hour)
+
+	msg, err := dec.decode(message{msgBegin}.uint64(100).uint64(uint64(time.Hour.Microseconds())).uint32(7))
+	require.NoError(t, err)
+	assert.Equal(t, &beginMessage{finalLSN: 100, commitTime: commitTime, xid: 7}, msg)
+
+	msg, err = dec.decode(message{msgCommit}.byte(0).uint64(100).uint64(120).uint64(uint64(time.Hour.Microseconds())))
+	require.NoError(t, err)
+	assert.Equal(t, &commitMessage{commitLSN: 100, endLSN: 120, commitTime: commitTime}, msg)
+}
+
+func TestDecoder_Changes(t *testing.T) {
+	dec := newDecoder()
+
+	msg, err := dec.decode(usersRelation())
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	msg, err = dec.decode(message{msgInsert}.uint32(16384).byte('N').row(userRow("Alice")...))
+	require.NoError(t, err)
+	change, err := msg.(*changeMessage).change()
+	require.NoError(t, err)
+	assert.Equal(t, OpInsert, change.Op)
+	assert.Equal(t, int64(42), change.User.ID)
+	assert.Equal(t, "Alice", change.User.Name)
+	assert.Equal(t, time.Date(2025, 3, 4, 5, 6, 7, 123456000, time.UTC), change.User.CreatedAt)
+	assert.Nil(t, change.Old)
+
+	msg, err = dec.decode(message{msgUpdate}.uint32(16384).
+		byte('O').row(userRow("Alice")...).
+		byte('N').row(userRow("Bob")...))
+	require.NoError(t, err)
+	change, err = msg.(*changeMessage).change()
+	require.NoError(t, err)
+	assert.Equal(t, OpUpdate, change.Op)
+	assert.Equal(t, "Bob", change.User.Name)
+	require.NotNil(t, change.Old)
+	assert.Equal(t, "Alice", change.Old.Name)
+
+	msg, err = dec.decode(message{msgDelete}.uint32(16384).byte('O').row(userRow("Bob")...))
+	require.NoError(t, err)
+	change, err = msg.(*changeMessage).change()
+	require.NoError(t, err)
+	assert.Equal(t, OpDelete, change.Op)
+	assert.Equal(t, "user_1", change.User.UserID)
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	dec := newDecoder()
+
+	_, err := dec.decode(message{msgInsert}.uint32(1).byte('N').row())
+	assert.ErrorContains(t, err, "unknown relation")
+
+	_, err = dec.decode(message{msgBegin}.uint32(1))
+	assert.ErrorIs(t, err, errShortMessage)
+
+	_, err = dec.decode(usersRelation())
+	require.NoError(t, err)
+	insert := message{msgInsert}.uint32(16384).byte('N').row(userRow("A")...)
+	_, err = dec.decode(insert[:len(insert)-3])
+	assert.ErrorIs(t, err, errShortMessage)
+}
@@ -0,0 +1,356 @@
+// Package cdc streams changes to the users table from every shard primary
+// through logical replication (pgoutput) and merges them into one channel.
+package cdc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+const (
+	defaultSlot           = "users_cdc"
+	defaultPublication    = "users_cdc"
+	defaultStatusInterval = 10 * time.Second
+
+	maxReconnectBackoff = 30 * time.Second
+
+	// pgDuplicateObject is returned when the slot already exists
+	pgDuplicateObject = "42710"
+)
+
+// Streaming replication messages, wrapped in CopyData
+const (
+	xLogDataMessage         = 'w'
+	primaryKeepaliveMessage = 'k'
+	standbyStatusMessage    = 'r'
+)
+
+// SubscriberOptions configures a Subscriber
+type SubscriberOptions struct {
+	// Slot is the logical replication slot used on every primary; it is created
+	// when missing. Defaults to "users_cdc"
+	Slot string
+
+	// Publication selects the published tables; defaults to "users_cdc"
+	Publication string
+
+	// StatusInterval is how often acknowledged positions are reported to the primaries; defaults to 10s
+	StatusInterval time.Duration
+
+	// Checkpoints are the positions to resume from, by shard ID
+	// Shards without one resume from their slot's confirmed position.
+	Checkpoints map[int]LSN
+
+	// Buffer is the capacity of the events channel
+	Buffer int
+}
+
+// Subscriber streams the users changes of every shard primary into one channel
+// Events of a shard arrive in commit order; events of different shards are
+// interleaved. Delivery is at least once: events that were not acknowledged
+// before a reconnect or a restart are delivered again.
+type Subscriber struct {
+	sm     *sharding.ShardManager
+	opts   SubscriberOptions
+	events chan Event
+
+	mu    sync.Mutex
+	acked map[int]LSN
+}
+
+// NewSubscriber creates a subscriber for the shard manager's primaries
+func NewSubscriber(sm *sharding.ShardManager, opts SubscriberOptions) *Subscriber {
+	if opts.Slot == "" {
+		opts.Slot = defaultSlot
+	}
+	if opts.Publication == "" {
+		opts.Publication = defaultPublication
+	}
+	if opts.StatusInterval <= 0 {
+		opts.StatusInterval = defaultStatusInterval
+	}
+
+	acked := make(map[int]LSN)
+	maps.Copy(acked, opts.Checkpoints)
+
+	return &Subscriber{
+		sm:     sm,
+		opts:   opts,
+		events: make(chan Event, opts.Buffer),
+		acked:  acked,
+	}
+}
+
+// Events returns the merged event channel; it is closed when Run returns
+func (s *Subscriber) Events() <-chan Event {
+	return s.events
+}
+
+// Ack records that every event of the shard up to lsn has been handled
+// The position is reported to the shard's slot, letting the primary recycle
+// WAL, and the stream resumes after it when it reconnects.
+func (s *Subscriber) Ack(shardID int, lsn LSN) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lsn > s.acked[shardID] {
+		s.acked[shardID] = lsn
+	}
+}
+
+// Checkpoints returns the acknowledged position of every shard
+// Positions past WAL without users changes are included once every delivered
+// event was acknowledged.
+func (s *Subscriber) Checkpoints() map[int]LSN {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.acked)
+}
+
+// ackIdle acknowledges lsn for a shard whose delivered events up to delivered
+// have all been acknowledged, and which has nothing else to deliver before lsn
+func (s *Subscriber) ackIdle(shardID int, delivered, lsn LSN) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.acked[shardID] >= delivered && lsn > s.acked[shardID] {
+		s.acked[shardID] = lsn
+	}
+}
+
+func (s *Subscriber) checkpoint(shardID int) LSN {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked[shardID]
+}
+
+// Run streams from every shard primary until ctx is cancelled, then closes the events channel
+// A failing stream is reconnected with backoff. The shards are taken from the
+// topology when Run starts.
+func (s *Subscriber) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, shard := range s.sm.GetAllShards() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runShard(ctx, shard)
+		}()
+	}
+	wg.Wait()
+	close(s.events)
+}
+
+// runShard keeps one shard's stream open until ctx is cancelled
+func (s *Subscriber) runShard(ctx context.Context, shard *sharding.Shard) {
+	backoff := time.Second
+	for {
+		err := s.stream(ctx, shard)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("cdc: shard %d: %v (retrying in %s)", shard.ShardID, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
+}
+
+// stream holds a single replication session and returns when it fails
+func (s *Subscriber) stream(ctx context.Context, shard *sharding.Shard) error {
+	cfg := shard.PrimaryConfig()
+	conn, err := pgconn.Connect(ctx, cfg.ConnectionString()+" replication=database")
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	slot := pgx.Identifier{s.opts.Slot}.Sanitize()
+	_, err = conn.Exec(ctx, "CREATE_REPLICATION_SLOT "+slot+" LOGICAL pgoutput NOEXPORT_SNAPSHOT").ReadAll()
+	var pgErr *pgconn.PgError
+	if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == pgDuplicateObject) {
+		return fmt.Errorf("failed to create replication slot: %w", err)
+	}
+
+	start := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL %s (proto_version '1', publication_names '%s')",
+		slot, s.checkpoint(shard.ShardID), strings.ReplaceAll(s.opts.Publication, "'", "''"))
+	if err := startReplication(ctx, conn, start); err != nil {
+		return err
+	}
+
+	st := &shardStream{shardID: shard.ShardID, dec: newDecoder()}
+	nextStatus := time.Now()
+	for {
+		if !time.Now().Before(nextStatus) {
+			if err := sendStatus(conn, s.checkpoint(shard.ShardID)); err != nil {
+				return fmt.Errorf("failed to send status: %w", err)
+			}
+			nextStatus = time.Now().Add(s.opts.StatusInterval)
+		}
+
+		recvCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(recvCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return fmt.Errorf("failed to receive message: %w", err)
+		}
+
+		var data []byte
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data = msg.Data
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyDone:
+			return errors.New("primary ended the replication stream")
+		default:
+			continue
+		}
+
+		event, reply, err := s.handle(st, data)
+		if err != nil {
+			return err
+		}
+		if reply {
+			nextStatus = time.Now()
+		}
+		if event != nil {
+			select {
+			case s.events <- *event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// shardStream is the state of one shard's replication session
+type shardStream struct {
+	shardID int
+	dec     *decoder
+
+	// pending collects the users changes of the open transaction
+	pending *Event
+
+	// delivered is the position of the last event handed out in this session
+	delivered LSN
+}
+
+// handle processes one streaming replication message
+// It returns the event a commit completed, if any, and whether the primary
+// asked for a status reply. Positions that only cover traffic without users
+// changes are acknowledged on the consumer's behalf once it has acknowledged
+// every delivered event, so that the slot keeps advancing on a shard where only
+// other tables are written; otherwise the primary would retain WAL forever.
+func (s *Subscriber) handle(st *shardStream, data []byte) (*Event, bool, error) {
+	if len(data) == 0 {
+		return nil, false, nil
+	}
+
+	switch data[0] {
+	case primaryKeepaliveMessage:
+		// wal end (8), server time (8), reply requested (1)
+		if len(data) < 18 {
+			return nil, false, fmt.Errorf("invalid keepalive message: %w", errShortMessage)
+		}
+		// Everything before wal end was sent, so with no transaction open it
+		// was either delivered or had no users changes
+		if st.pending == nil {
+			s.ackIdle(st.shardID, st.delivered, LSN(binary.BigEndian.Uint64(data[1:])))
+		}
+		return nil, data[17] == 1, nil
+
+	case xLogDataMessage:
+		// wal start (8), wal end (8), server time (8), pgoutput message
+		if len(data) < 25 {
+			return nil, false, fmt.Errorf("invalid XLogData message: %w", errShortMessage)
+		}
+		decoded, err := st.dec.decode(data[25:])
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch m := decoded.(type) {
+		case *beginMessage:
+			st.pending = &Event{ShardID: st.shardID, CommitTime: m.commitTime}
+		case *changeMessage:
+			if st.pending == nil {
+				return nil, false, errors.New("change outside of a transaction")
+			}
+			if m.rel.namespace != "public" || m.rel.name != "users" {
+				return nil, false, nil
+			}
+			change, err := m.change()
+			if err != nil {
+				return nil, false, err
+			}
+			st.pending.Changes = append(st.pending.Changes, change)
+		case *commitMessage:
+			event := st.pending
+			st.pending = nil
+			if event == nil || len(event.Changes) == 0 {
+				s.ackIdle(st.shardID, st.delivered, m.endLSN)
+				return nil, false, nil
+			}
+			event.LSN = m.endLSN
+			st.delivered = m.endLSN
+			return event, false, nil
+		}
+	}
+
+	return nil, false, nil
+}
+
+// startReplication sends START_REPLICATION and waits for the server to enter copy-both mode
+func startReplication(ctx context.Context, conn *pgconn.PgConn, query string) error {
+	conn.Frontend().Send(&pgproto3.Query{String: query})
+	if err := conn.Frontend().Flush(); err != nil {
+		return fmt.Errorf("failed to start replication: %w", err)
+	}
+
+	for {
+		msg, err := conn.ReceiveMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to start replication: %w", err)
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("failed to start replication: %w", pgconn.ErrorResponseToPgError(msg))
+		}
+	}
+}
+
+// sendStatus reports lsn as written, flushed and applied
+// The flushed position becomes the slot's confirmed position.
+func sendStatus(conn *pgconn.PgConn, lsn LSN) error {
+	buf := make([]byte, 34)
+	buf[0] = standbyStatusMessage
+	binary.BigEndian.PutUint64(buf[1:], uint64(lsn))
+	binary.BigEndian.PutUint64(buf[9:], uint64(lsn))
+	binary.BigEndian.PutUint64(buf[17:], uint64(lsn))
+	binary.BigEndian.PutUint64(buf[25:], uint64(time.Since(pgEpoch).Microseconds()))
+	// buf[33] = 0: no reply requested
+
+	conn.Frontend().Send(&pgproto3.CopyData{Data: buf})
+	return conn.Frontend().Flush()
+}
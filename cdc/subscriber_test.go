@@ -0,0 +1,135 @@
+package cdc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keepalive builds a primary keepalive message
+func keepalive(walEnd LSN, reply bool) []byte {
+	m := message{primaryKeepaliveMessage}.uint64(uint64(walEnd)).uint64(0)
+	if reply {
+		return m.byte(1)
+	}
+	return m.byte(0)
+}
+
+// xLogData wraps a pgoutput message in an XLogData message
+func xLogData(m message) []byte {
+	return append(message{xLogDataMessage}.uint64(0).uint64(0).uint64(0), m...)
+}
+
+func begin(finalLSN LSN) []byte {
+	return xLogData(message{msgBegin}.uint64(uint64(finalLSN)).uint64(0).uint32(1))
+}
+
+func commit(endLSN LSN) []byte {
+	return xLogData(message{msgCommit}.byte(0).uint64(uint64(endLSN)).uint64(uint64(endLSN)).uint64(0))
+}
+
+func TestSubscriber_AdvancesWithoutUserChanges(t *testing.T) {
+	sub := NewSubscriber(nil, SubscriberOptions{})
+	st := &shardStream{shardID: 1, dec: newDecoder()}
+	handle := func(data []byte) *Event {
+		event, _, err := sub.handle(st, data)
+		require.NoError(t, err)
+		return event
+	}
+
+	// Only outbox traffic: the slot follows the commits and keepalives
+	outbox := message{msgRelation}.uint32(16385).cstring("public").cstring("outbox").byte('f').uint16(1).
+		byte(0).cstring("id").uint32(20).uint32(0)
+	assert.Nil(t, handle(xLogData(outbox)))
+	assert.Nil(t, handle(begin(100)))
+	assert.Nil(t, handle(xLogData(message{msgInsert}.uint32(16385).byte('N').row(str("1")))))
+	assert.Nil(t, handle(commit(110)))
+	assert.Equal(t, LSN(110), sub.Checkpoints()[1])
+
+	_, reply, err := sub.handle(st, keepalive(200, true))
+	require.NoError(t, err)
+	assert.True(t, reply)
+	assert.Equal(t, LSN(200), sub.Checkpoints()[1])
+
+	// A delivered event holds the position until the consumer acknowledges it
+	assert.Nil(t, handle(xLogData(usersRelation())))
+	assert.Nil(t, handle(begin(300)))
+	assert.Nil(t, handle(xLogData(message{msgInsert}.uint32(16384).byte('N').row(userRow("Alice")...))))
+	event := handle(commit(310))
+	require.NotNil(t, event)
+	assert.Equal(t, LSN(310), event.LSN)
+
+	handle(keepalive(400, false))
+	assert.Equal(t, LSN(200), sub.Checkpoints()[1])
+
+	sub.Ack(1, event.LSN)
+	handle(keepalive(400, false))
+	assert.Equal(t, LSN(400), sub.Checkpoints()[1])
+
+	// Nor does a keepalive move it while a transaction is open
+	handle(begin(500))
+	handle(keepalive(600, false))
+	assert.Equal(t, LSN(400), sub.Checkpoints()[1])
+}
+
+func TestSubscriber_StreamsUserChanges(t *testing.T) {
+	sm, err := sharding.NewShardManager(config.DefaultConfig())
+	require.NoError(t, err)
+	defer sm.Close()
+
+	const slot = "users_cdc_test"
+	key := "cdc_test_user"
+	primary := sm.GetPrimaryDB(key)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	sub := NewSubscriber(sm, SubscriberOptions{Slot: slot, StatusInterval: time.Second})
+	done := make(chan struct{})
+	go func() {
+		sub.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+		for _, shard := range sm.GetAllShards() {
+			shard.Primary.Exec(`SELECT pg_drop_replication_slot($1)`, slot)
+		}
+		primary.Exec(`DELETE FROM users WHERE user_id = $1`, key)
+	}()
+
+	// Changes made before the slot exists are not streamed
+	require.Eventually(t, func() bool {
+		var active bool
+		err := primary.QueryRow(`SELECT active FROM pg_replication_slots WHERE slot_name = $1`, slot).Scan(&active)
+		return err == nil && active
+	}, 10*time.Second, 100*time.Millisecond)
+
+	_, err = primary.Exec(`INSERT INTO users (user_id, name, email) VALUES ($1, 'Before', 'cdc_test@example.com')`, key)
+	require.NoError(t, err)
+	_, err = primary.Exec(`UPDATE users SET name = 'After' WHERE user_id = $1`, key)
+	require.NoError(t, err)
+
+	var changes []Change
+	for len(changes) < 2 {
+		select {
+		case event := <-sub.Events():
+			assert.Equal(t, sm.GetShardID(key), event.ShardID)
+			changes = append(changes, event.Changes...)
+			sub.Ack(event.ShardID, event.LSN)
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for changes")
+		}
+	}
+
+	assert.Equal(t, OpInsert, changes[0].Op)
+	assert.Equal(t, key, changes[0].User.UserID)
+	assert.Equal(t, OpUpdate, changes[1].Op)
+	assert.Equal(t, "After", changes[1].User.Name)
+	assert.Equal(t, "Before", changes[1].Old.Name)
+	assert.NotZero(t, sub.Checkpoints()[sm.GetShardID(key)])
+}
@@ -0,0 +1,68 @@
+// Command email-index verifies the global email index against the users tables
+// and, with -repair, fixes the drift it finds.
+//
+//	go run ./cmd/email-index            # report only
+//	go run ./cmd/email-index -repair    # rebuild missing and remove orphaned entries
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/samandartukhtayev/replication-and-sharding/repository"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "add missing entries and remove orphaned ones")
+	minAge := flag.Duration("min-age", 5*time.Minute, "ignore entries younger than this when looking for orphans")
+	batchSize := flag.Int("batch-size", 500, "users checked per round trip")
+	flag.Parse()
+
+	sm, err := sharding.NewShardManagerWithOptions(config.DefaultConfig(), sharding.Options{Startup: sharding.RequirePrimaries})
+	if err != nil {
+		log.Fatalf("Failed to create shard manager: %v", err)
+	}
+	defer sm.Close()
+
+	repo := repository.NewUserRepository(sm)
+
+	rep, err := repo.VerifyEmailIndex(context.Background(), repository.IndexCheckOptions{
+		Repair:    *repair,
+		MinAge:    *minAge,
+		BatchSize: *batchSize,
+	})
+	if err != nil {
+		log.Fatalf("Failed to verify email index: %v", err)
+	}
+
+	fmt.Printf("Checked %d users\n", rep.Users)
+	for _, entry := range rep.Missing {
+		fmt.Printf("  missing:  %s → %s\n", entry.Value, entry.Owner)
+	}
+	for _, entry := range rep.Conflicts {
+		fmt.Printf("  conflict: %s is also used by %s\n", entry.Value, entry.Owner)
+	}
+	for _, entry := range rep.Orphans {
+		fmt.Printf("  orphan:   %s → %s\n", entry.Value, entry.Owner)
+	}
+
+	if *repair {
+		fmt.Printf("Repaired %d entries\n", rep.Repaired)
+	}
+
+	if rep.Consistent() {
+		fmt.Println("✓ Email index is consistent")
+		return
+	}
+
+	// Conflicts need a human to decide which user keeps the email
+	if !*repair || len(rep.Conflicts) > 0 {
+		os.Exit(1)
+	}
+}
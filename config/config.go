@@ -23,6 +23,14 @@ type DatabaseConfig struct {
 // Config holds the complete application configuration
 type Config struct {
 	Shards []ShardConfig
+
+	// Buckets maps hash buckets to shard IDs (bucket index -> ShardID)
+	// When empty, keys are routed with a plain modulo over the shards
+	Buckets []int
+
+	// Version is the topology version this configuration was built from
+	// Static configurations use version 0, the catalog assigns increasing versions
+	Version int64
 }
 
 // ConnectionString returns a PostgreSQL connection string
@@ -97,3 +105,14 @@ func DefaultConfig() *Config {
 		},
 	}
 }
+
+// DefaultCatalogConfig returns the connection settings of the topology catalog database
+func DefaultCatalogConfig() DatabaseConfig {
+	return DatabaseConfig{
+		Host:     "localhost",
+		Port:     5450,
+		User:     "postgres",
+		Password: "postgres",
+		DBName:   "catalog",
+	}
+}
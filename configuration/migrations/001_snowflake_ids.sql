@@ -0,0 +1,24 @@
+-- Switches users.id from SERIAL to globally unique Snowflake-style IDs
+-- Run once per shard primary with the shard's ID:
+--   psql -v shard_id=0 -f 001_snowflake_ids.sql
+-- Existing rows keep their small serial IDs. Those IDs do not encode a shard
+-- (they would decode as shard 0), so GetByID reports them as not found; look
+-- legacy rows up by user_id instead.
+
+BEGIN;
+
+CREATE SEQUENCE IF NOT EXISTS users_id_seq;
+
+CREATE OR REPLACE FUNCTION users_next_id(shard_id INT) RETURNS BIGINT AS $$
+    SELECT ((FLOOR(EXTRACT(EPOCH FROM clock_timestamp()) * 1000)::BIGINT - 1704067200000) << 22)
+         | ((shard_id::BIGINT & 1023) << 12)
+         | (nextval('users_id_seq') % 4096)
+$$ LANGUAGE SQL VOLATILE;
+
+ALTER TABLE users ALTER COLUMN id TYPE BIGINT;
+ALTER TABLE users ALTER COLUMN id SET DEFAULT users_next_id(:shard_id);
+
+-- The sequence now only feeds the low bits and must outlive the SERIAL column
+ALTER SEQUENCE users_id_seq AS BIGINT OWNED BY NONE;
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Adds the reservation table backing cluster-wide unique emails
+-- Users created before this migration have no reservation; run
+-- `make rebuild-email-index` afterwards to reserve their emails.
+
+CREATE TABLE IF NOT EXISTS unique_reservations (
+    scope VARCHAR(64) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    owner VARCHAR(255) NOT NULL,
+    reserved_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, value)
+);
@@ -0,0 +1,10 @@
+-- Adds the coordinator log of the two-phase commit coordinator
+-- PREPARE TRANSACTION also needs max_prepared_transactions > 0, which requires a restart
+-- (see the command lines in docker-compose.yml).
+
+CREATE TABLE IF NOT EXISTS twophase_log (
+    gid VARCHAR(200) PRIMARY KEY,
+    state VARCHAR(16) NOT NULL,
+    shards INT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
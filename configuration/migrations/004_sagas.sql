@@ -0,0 +1,23 @@
+-- Adds saga state (used on the coordinator shard) and the per-shard step markers
+
+CREATE TABLE IF NOT EXISTS sagas (
+    id VARCHAR(64) PRIMARY KEY,
+    saga_type VARCHAR(255) NOT NULL,
+    payload BYTEA,
+    state VARCHAR(16) NOT NULL,
+    step INT NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_sagas_unfinished ON sagas(updated_at)
+    WHERE state IN ('running', 'compensating');
+
+CREATE TABLE IF NOT EXISTS saga_steps (
+    saga_id VARCHAR(64) NOT NULL,
+    step INT NOT NULL,
+    compensation BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (saga_id, step, compensation)
+);
@@ -0,0 +1,12 @@
+-- Prepares the users table for change data capture
+-- Requires wal_level=logical on the primary (see docker-compose.yml)
+
+ALTER TABLE users REPLICA IDENTITY FULL;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = 'users_cdc') THEN
+        CREATE PUBLICATION users_cdc FOR TABLE users;
+    END IF;
+END
+$$;
@@ -0,0 +1,4 @@
+-- Adds the row version used by optimistic concurrency control in UserRepository.Update
+-- Existing users start at version 1, like new ones
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
@@ -0,0 +1,15 @@
+-- Adds the per-shard idempotency keys of UserRepository.CreateIdempotent and UpdateIdempotent
+-- Keys are scoped to the user they write and live on that user's shard;
+-- response is the stored result (NULL only while the claiming transaction is in flight)
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    operation VARCHAR(32) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    response JSONB,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
@@ -0,0 +1,11 @@
+-- Adds the routing epoch that fences writes from instances with a stale topology
+-- Shards start at epoch 0, which managers built from a static configuration use;
+-- ShardManager.PublishEpoch raises it after a catalog change
+
+CREATE TABLE IF NOT EXISTS routing_epoch (
+    singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+    epoch BIGINT NOT NULL
+);
+
+INSERT INTO routing_epoch (epoch) VALUES (0)
+ON CONFLICT (singleton) DO NOTHING;
@@ -0,0 +1,4 @@
+-- Adds the index ListUsers and ordered scans read in (created_at DESC, id DESC) order
+-- Built concurrently so writes to users continue while it builds
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_users_created_at_id ON users(created_at DESC, id DESC);
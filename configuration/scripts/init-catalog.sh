@@ -0,0 +1,85 @@
+#!/bin/bash
+set -e
+
+echo "Starting catalog initialization..."
+
+# Create catalog schema
+psql -v ON_ERROR_STOP=1 --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
+    CREATE TABLE IF NOT EXISTS shards (
+        shard_id INT PRIMARY KEY
+    );
+
+    CREATE TABLE IF NOT EXISTS nodes (
+        node_id SERIAL PRIMARY KEY,
+        shard_id INT NOT NULL REFERENCES shards(shard_id),
+        role VARCHAR(16) NOT NULL CHECK (role IN ('primary', 'replica')),
+        host VARCHAR(255) NOT NULL,
+        port INT NOT NULL,
+        username VARCHAR(255) NOT NULL,
+        password VARCHAR(255) NOT NULL,
+        dbname VARCHAR(255) NOT NULL
+    );
+
+    -- At most one primary per shard
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_nodes_one_primary ON nodes(shard_id) WHERE role = 'primary';
+
+    CREATE TABLE IF NOT EXISTS buckets (
+        bucket INT PRIMARY KEY,
+        shard_id INT NOT NULL REFERENCES shards(shard_id)
+    );
+
+    -- Single-row table holding the current topology version
+    CREATE TABLE IF NOT EXISTS topology_version (
+        singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+        version BIGINT NOT NULL
+    );
+
+    INSERT INTO topology_version (version) VALUES (1)
+    ON CONFLICT (singleton) DO NOTHING;
+
+    -- Any change to the topology bumps the version and notifies listeners
+    CREATE OR REPLACE FUNCTION bump_topology_version() RETURNS trigger AS \$\$
+    DECLARE
+        new_version BIGINT;
+    BEGIN
+        UPDATE topology_version SET version = version + 1 RETURNING version INTO new_version;
+        PERFORM pg_notify('topology_changed', new_version::text);
+        RETURN NULL;
+    END;
+    \$\$ LANGUAGE plpgsql;
+
+    DROP TRIGGER IF EXISTS shards_topology_changed ON shards;
+    CREATE TRIGGER shards_topology_changed AFTER INSERT OR UPDATE OR DELETE ON shards
+        FOR EACH STATEMENT EXECUTE FUNCTION bump_topology_version();
+
+    DROP TRIGGER IF EXISTS nodes_topology_changed ON nodes;
+    CREATE TRIGGER nodes_topology_changed AFTER INSERT OR UPDATE OR DELETE ON nodes
+        FOR EACH STATEMENT EXECUTE FUNCTION bump_topology_version();
+
+    DROP TRIGGER IF EXISTS buckets_topology_changed ON buckets;
+    CREATE TRIGGER buckets_topology_changed AFTER INSERT OR UPDATE OR DELETE ON buckets
+        FOR EACH STATEMENT EXECUTE FUNCTION bump_topology_version();
+
+    -- Seed the topology matching config.DefaultConfig
+    -- 12 buckets assigned round-robin route exactly like hash % 3
+    INSERT INTO shards (shard_id) VALUES (0), (1), (2)
+    ON CONFLICT (shard_id) DO NOTHING;
+
+    INSERT INTO nodes (shard_id, role, host, port, username, password, dbname)
+    SELECT * FROM (VALUES
+        (0, 'primary', 'localhost', 5440, 'postgres', 'postgres', 'shard0'),
+        (0, 'replica', 'localhost', 5441, 'postgres', 'postgres', 'shard0'),
+        (1, 'primary', 'localhost', 5442, 'postgres', 'postgres', 'shard1'),
+        (1, 'replica', 'localhost', 5443, 'postgres', 'postgres', 'shard1'),
+        (2, 'primary', 'localhost', 5444, 'postgres', 'postgres', 'shard2'),
+        (2, 'replica', 'localhost', 5445, 'postgres', 'postgres', 'shard2')
+    ) AS seed
+    WHERE NOT EXISTS (SELECT 1 FROM nodes);
+
+    INSERT INTO buckets (bucket, shard_id)
+    SELECT b, b % 3 FROM generate_series(0, 11) AS b
+    ON CONFLICT (bucket) DO NOTHING;
+EOSQL
+
+echo "Catalog initialization completed successfully"
+echo "Database: $POSTGRES_DB"
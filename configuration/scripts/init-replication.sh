@@ -38,15 +38,119 @@ echo "host replication replicator 0.0.0.0/0 md5" >> "$PGDATA/pg_hba.conf"
 
 # Create application schema
 psql -v ON_ERROR_STOP=1 --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" <<-EOSQL
+    -- Globally unique Snowflake-style IDs: 41 bits of milliseconds since
+    -- 2024-01-01, 10 bits of shard ID and 12 bits of per-shard sequence.
+    -- Must match the layout in sharding/snowflake.go
+    CREATE SEQUENCE IF NOT EXISTS users_id_seq;
+
+    CREATE OR REPLACE FUNCTION users_next_id(shard_id INT) RETURNS BIGINT AS \$\$
+        SELECT ((FLOOR(EXTRACT(EPOCH FROM clock_timestamp()) * 1000)::BIGINT - 1704067200000) << 22)
+             | ((shard_id::BIGINT & 1023) << 12)
+             | (nextval('users_id_seq') % 4096)
+    \$\$ LANGUAGE SQL VOLATILE;
+
     CREATE TABLE IF NOT EXISTS users (
-        id SERIAL PRIMARY KEY,
+        id BIGINT PRIMARY KEY DEFAULT users_next_id(${SHARD_ID:-0}),
         user_id VARCHAR(255) NOT NULL UNIQUE,
         name VARCHAR(255) NOT NULL,
         email VARCHAR(255) NOT NULL,
-        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+        version BIGINT NOT NULL DEFAULT 1
     );
 
     CREATE INDEX IF NOT EXISTS idx_users_user_id ON users(user_id);
+
+    -- Old rows are logged in full, so CDC sees every column of updated and deleted users
+    ALTER TABLE users REPLICA IDENTITY FULL;
+
+    -- Publication streamed by the CDC subscriber's pgoutput slots
+    DO \$\$
+    BEGIN
+        IF NOT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = 'users_cdc') THEN
+            CREATE PUBLICATION users_cdc FOR TABLE users;
+        END IF;
+    END
+    \$\$;
+
+    -- Supports cursor pagination ordered by creation time
+    CREATE INDEX IF NOT EXISTS idx_users_created_at_id ON users(created_at DESC, id DESC);
+
+    -- Cluster-wide unique values (e.g. emails), sharded by the hash of the value
+    -- and owned by the user_id of the row using them
+    CREATE TABLE IF NOT EXISTS unique_reservations (
+        scope VARCHAR(64) NOT NULL,
+        value VARCHAR(255) NOT NULL,
+        owner VARCHAR(255) NOT NULL,
+        reserved_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (scope, value)
+    );
+
+    -- Coordinator log of the two-phase commit coordinator; only the log shard's copy is used
+    CREATE TABLE IF NOT EXISTS twophase_log (
+        gid VARCHAR(200) PRIMARY KEY,
+        state VARCHAR(16) NOT NULL,
+        shards INT[] NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    -- Saga state; only the coordinator shard's copy is used
+    CREATE TABLE IF NOT EXISTS sagas (
+        id VARCHAR(64) PRIMARY KEY,
+        saga_type VARCHAR(255) NOT NULL,
+        payload BYTEA,
+        state VARCHAR(16) NOT NULL,
+        step INT NOT NULL,
+        last_error TEXT,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_sagas_unfinished ON sagas(updated_at)
+        WHERE state IN ('running', 'compensating');
+
+    -- Markers of the saga steps applied on this shard, written with the step's changes
+    CREATE TABLE IF NOT EXISTS saga_steps (
+        saga_id VARCHAR(64) NOT NULL,
+        step INT NOT NULL,
+        compensation BOOLEAN NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (saga_id, step, compensation)
+    );
+
+    -- Transactional outbox: events written with the changes they describe, delivered by the relay
+    CREATE TABLE IF NOT EXISTS outbox (
+        id BIGSERIAL PRIMARY KEY,
+        aggregate_id VARCHAR(255) NOT NULL,
+        event_type VARCHAR(64) NOT NULL,
+        payload JSONB NOT NULL,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        delivered_at TIMESTAMP
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(aggregate_id, id)
+        WHERE delivered_at IS NULL;
+
+    -- Idempotency keys of retried writes, with the result they return on replay
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        user_id VARCHAR(255) NOT NULL,
+        key VARCHAR(255) NOT NULL,
+        operation VARCHAR(32) NOT NULL,
+        request_hash CHAR(64) NOT NULL,
+        response JSONB,
+        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (user_id, key)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+
+    -- Routing epoch used to fence writes from instances with a stale topology
+    CREATE TABLE IF NOT EXISTS routing_epoch (
+        singleton BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (singleton),
+        epoch BIGINT NOT NULL
+    );
+
+    INSERT INTO routing_epoch (epoch) VALUES (0)
+    ON CONFLICT (singleton) DO NOTHING;
     
     -- Insert sample data for testing
     INSERT INTO users (user_id, name, email) 
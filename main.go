@@ -6,7 +6,6 @@ import (
 	"log"
 	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/samandartukhtayev/replication-and-sharding/config"
 	"github.com/samandartukhtayev/replication-and-sharding/models"
 	"github.com/samandartukhtayev/replication-and-sharding/repository"
@@ -21,13 +20,25 @@ func main() {
 	fmt.Printf("Initialized with %d shards\n", len(cfg.Shards))
 
 	// Create shard manager
-	sm, err := sharding.NewShardManager(cfg)
+	// A broken replica shouldn't stop the demo, so only primaries are required
+	sm, err := sharding.NewShardManagerWithOptions(cfg, sharding.Options{Startup: sharding.RequirePrimaries})
 	if err != nil {
 		log.Fatalf("Failed to create shard manager: %v", err)
 	}
 	defer sm.Close()
 
-	fmt.Println("✓ Connected to all database shards and replicas")
+	if status := sm.Status(); status.Degraded() {
+		fmt.Println("⚠ Started in degraded mode:")
+		for _, shard := range status.Shards {
+			for _, replica := range shard.Replicas {
+				if replica.State == sharding.NodeDown {
+					fmt.Printf("  Shard %d replica %s is down: %s\n", shard.ShardID, replica.Address, replica.LastError)
+				}
+			}
+		}
+	} else {
+		fmt.Println("✓ Connected to all database shards and replicas")
+	}
 
 	// Create repository
 	repo := repository.NewUserRepository(sm)
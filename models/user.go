@@ -4,9 +4,10 @@ import "time"
 
 // User represents a user in our system
 type User struct {
-	ID        int       `json:"id"`
-	UserID    string    `json:"user_id"`    // This is the shard key
+	ID        int64     `json:"id"`      // Globally unique; encodes the shard (see sharding.DecodeID)
+	UserID    string    `json:"user_id"` // This is the shard key
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
 	CreatedAt time.Time `json:"created_at"`
-}
\ No newline at end of file
+	Version   int64     `json:"version"` // Incremented by every update; Update requires the current value
+}
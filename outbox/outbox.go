@@ -0,0 +1,68 @@
+// Package outbox publishes events reliably through a per-shard transactional outbox
+// Writers append events to the outbox table in the same transaction as their
+// changes; a Relay later delivers them to a Sink and marks them delivered.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// Message is an event to be appended to the outbox
+type Message struct {
+	// AggregateID is the shard key the event is about; events of one aggregate are delivered in order
+	AggregateID string
+	Type        string
+
+	// Payload is marshalled to JSON
+	Payload any
+}
+
+// Event is a message read back from a shard's outbox
+// Delivery is at least once; (ShardID, ID) identifies an event for deduplication.
+type Event struct {
+	ShardID     int             `json:"shard_id"`
+	ID          int64           `json:"id"`
+	AggregateID string          `json:"aggregate_id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Append inserts messages into the outbox of the transaction's shard
+// Call it inside the transaction that makes the change the messages describe.
+func Append(ctx context.Context, tx sharding.Tx, messages ...Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	aggregateIDs := make([]string, len(messages))
+	types := make([]string, len(messages))
+	payloads := make([]string, len(messages))
+	for i, m := range messages {
+		payload, err := json.Marshal(m.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s event: %w", m.Type, err)
+		}
+		aggregateIDs[i] = m.AggregateID
+		types[i] = m.Type
+		payloads[i] = string(payload)
+	}
+
+	// WITH ORDINALITY keeps the ids in input order
+	_, err := tx.Exec(ctx, `
+		INSERT INTO outbox (aggregate_id, event_type, payload)
+		SELECT aggregate_id, event_type, payload::jsonb
+		FROM unnest($1::text[], $2::text[], $3::text[]) WITH ORDINALITY AS m(aggregate_id, event_type, payload, n)
+		ORDER BY n
+	`, aggregateIDs, types, payloads)
+	if err != nil {
+		return fmt.Errorf("failed to append to outbox: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySink(t *testing.T) {
+	sink := NewMemorySink()
+	ctx := context.Background()
+
+	require.NoError(t, sink.Deliver(ctx, []Event{{ID: 1}, {ID: 2}}))
+	require.NoError(t, sink.Deliver(ctx, []Event{{ID: 3}}))
+
+	events := sink.Events()
+	require.Len(t, events, 3)
+	assert.Equal(t, int64(3), events[2].ID)
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := NewFileSink(path)
+	require.NoError(t, err)
+
+	events := []Event{
+		{ShardID: 1, ID: 7, AggregateID: "user_1", Type: "user.created", Payload: json.RawMessage(`{"name":"A"}`)},
+		{ShardID: 1, ID: 8, AggregateID: "user_1", Type: "user.updated", Payload: json.RawMessage(`{"name":"B"}`)},
+	}
+	require.NoError(t, sink.Deliver(context.Background(), events))
+	require.NoError(t, sink.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var read []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		read = append(read, e)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, read, 2)
+	assert.Equal(t, "user.updated", read[1].Type)
+	assert.JSONEq(t, `{"name":"B"}`, string(read[1].Payload))
+}
+
+func TestRelay_DeliversInOrder(t *testing.T) {
+	sm, err := sharding.NewShardManager(config.DefaultConfig())
+	require.NoError(t, err)
+	defer sm.Close()
+
+	ctx := context.Background()
+	key := "outbox_order_user"
+	defer sm.GetPrimaryDB(key).Exec(`DELETE FROM outbox WHERE aggregate_id = $1`, key)
+
+	for i := 0; i < 3; i++ {
+		err := sm.WithWriteTx(ctx, key, func(tx *sharding.ShardTx) error {
+			return Append(ctx, tx, Message{AggregateID: key, Type: "test.event", Payload: map[string]int{"n": i}})
+		})
+		require.NoError(t, err)
+	}
+
+	sink := NewMemorySink()
+	relay := NewRelay(sm, sink, RelayOptions{BatchSize: 2})
+	for {
+		delivered, err := relay.RunOnce(ctx)
+		require.NoError(t, err)
+		if delivered == 0 {
+			break
+		}
+	}
+
+	var got []int
+	for _, e := range sink.Events() {
+		if e.AggregateID != key {
+			continue
+		}
+		var payload map[string]int
+		require.NoError(t, json.Unmarshal(e.Payload, &payload))
+		got = append(got, payload["n"])
+	}
+	assert.Equal(t, []int{0, 1, 2}, got, "Events of one aggregate should be delivered once, in order")
+}
@@ -0,0 +1,181 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 100
+)
+
+// RelayOptions configures a Relay
+type RelayOptions struct {
+	// PollInterval is the wait between polls that found nothing; defaults to 1s
+	PollInterval time.Duration
+
+	// BatchSize is the maximum number of events delivered per shard and poll; defaults to 100
+	BatchSize int
+}
+
+// Relay delivers the events of every shard's outbox to a sink
+// Several relays may run against the same shards: rows are claimed with
+// FOR UPDATE SKIP LOCKED, and an aggregate's events are only claimed by the
+// relay holding its oldest undelivered event, which keeps them in order.
+type Relay struct {
+	sm   *sharding.ShardManager
+	sink Sink
+	opts RelayOptions
+}
+
+// NewRelay creates a relay from the shard manager's primaries to sink
+func NewRelay(sm *sharding.ShardManager, sink Sink, opts RelayOptions) *Relay {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	return &Relay{sm: sm, sink: sink, opts: opts}
+}
+
+// Run polls the outboxes until ctx is cancelled
+// Shards with a full batch are polled again right away; failures are logged
+// and the events are retried on the next poll.
+func (r *Relay) Run(ctx context.Context) {
+	for {
+		delivered, err := r.RunOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("outbox relay: %v", err)
+		}
+
+		if delivered < r.opts.BatchSize {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.opts.PollInterval):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// RunOnce delivers one batch from every shard and returns the largest batch delivered
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	result, err := sharding.FanOut(ctx, r.sm.GetAllShards(), sharding.FanOutOptions{Policy: sharding.BestEffort},
+		func(ctx context.Context, shard *sharding.Shard) (int, error) {
+			return r.relayShard(ctx, shard)
+		})
+	if result == nil {
+		return 0, err
+	}
+
+	largest := 0
+	for _, res := range result.Results {
+		largest = max(largest, res.Value)
+	}
+	for shardID, shardErr := range result.Failed() {
+		if err == nil {
+			err = fmt.Errorf("shard %d: %w", shardID, shardErr)
+		}
+	}
+
+	return largest, err
+}
+
+// relayShard claims, delivers and marks one batch of a shard's outbox
+func (r *Relay) relayShard(ctx context.Context, shard *sharding.Shard) (int, error) {
+	// Only the oldest undelivered event of each aggregate can be claimed, so
+	// an aggregate's events are never split between two relays
+	heads := `
+		SELECT id
+		FROM outbox o
+		WHERE delivered_at IS NULL
+		  AND NOT EXISTS (
+			SELECT 1 FROM outbox p
+			WHERE p.aggregate_id = o.aggregate_id AND p.delivered_at IS NULL AND p.id < o.id
+		  )
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`
+	// Holding an aggregate's head keeps other relays away from the rest of its events
+	claim := `
+		SELECT id, aggregate_id, event_type, payload, created_at
+		FROM outbox
+		WHERE delivered_at IS NULL
+		  AND aggregate_id IN (SELECT aggregate_id FROM outbox WHERE id = ANY($1))
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE
+	`
+
+	tx, err := shard.PrimaryQuerier().Begin(ctx, sharding.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, heads, r.opts.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim events: %w", err)
+	}
+	var headIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan event: %w", err)
+		}
+		headIDs = append(headIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating events: %w", err)
+	}
+	if len(headIDs) == 0 {
+		return 0, nil
+	}
+
+	rows, err = tx.Query(ctx, claim, headIDs, r.opts.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim events: %w", err)
+	}
+	var events []Event
+	var ids []int64
+	for rows.Next() {
+		e := Event{ShardID: shard.ShardID}
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.AggregateID, &e.Type, &payload, &e.CreatedAt); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan event: %w", err)
+		}
+		e.Payload = payload
+		events = append(events, e)
+		ids = append(ids, e.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating events: %w", err)
+	}
+
+	if err := r.sink.Deliver(ctx, events); err != nil {
+		return 0, fmt.Errorf("failed to deliver events: %w", err)
+	}
+
+	// A failure from here on redelivers the batch: delivery is at least once
+	if _, err := tx.Exec(ctx, `UPDATE outbox SET delivered_at = CURRENT_TIMESTAMP WHERE id = ANY($1)`, ids); err != nil {
+		return 0, fmt.Errorf("failed to mark events delivered: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to commit delivered events: %w", err)
+	}
+
+	return len(events), nil
+}
@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/outbox"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// defaultBatchChunkSize is the number of users inserted per statement
+const defaultBatchChunkSize = 500
+
+// BatchOptions configures CreateBatch
+type BatchOptions struct {
+	// AtomicPerShard creates each shard's users all-or-nothing: if one of them
+	// fails, none of the users routed to that shard are created.
+	// Otherwise users whose user_id already exists are skipped individually.
+	AtomicPerShard bool
+
+	// ChunkSize is the number of users per INSERT statement; defaults to 500
+	ChunkSize int
+}
+
+// BatchResult is the outcome of creating one user of a batch
+type BatchResult struct {
+	User *models.User
+	Err  error
+}
+
+// CreateBatch creates many users with one multi-row INSERT ... RETURNING per shard chunk
+// (COPY would be faster but cannot return the generated IDs). Users are grouped
+// by shard and the shards are written in parallel. IDs and CreatedAt are filled in
+// on success. Results are returned in input order; the error is non-nil if at
+// least one user was not created.
+func (r *UserRepository) CreateBatch(ctx context.Context, users []*models.User, opts BatchOptions) ([]BatchResult, error) {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultBatchChunkSize
+	}
+
+	results := make([]BatchResult, len(users))
+
+	// Reserve all emails up front; users whose email is taken are not inserted
+	reservations := make([]sharding.Reservation, len(users))
+	for i, user := range users {
+		reservations[i] = sharding.Reservation{Value: normalizeEmail(user.Email), Owner: user.UserID}
+	}
+	reserved := r.emails.ReserveMany(ctx, reservations)
+
+	groups := make(map[int][]int)
+	for i, user := range users {
+		results[i].User = user
+		if reserved[i].Err != nil {
+			results[i].Err = fmt.Errorf("failed to create user: %w", reserved[i].Err)
+			continue
+		}
+		shardID := r.shardManager.GetShardID(user.UserID)
+		groups[shardID] = append(groups[shardID], i)
+	}
+
+	var shards []*sharding.Shard
+	for shardID := range groups {
+		shard, err := r.shardManager.GetShardByID(shardID)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+
+	fanOut := r.fanOut
+	fanOut.Policy = sharding.BestEffort
+	fanOut.ShardTimeout = 0
+
+	// Every shard writes only to its own items' results, so no locking is needed
+	fanned, _ := sharding.FanOut(ctx, shards, fanOut, func(ctx context.Context, shard *sharding.Shard) (struct{}, error) {
+		r.createShardBatch(ctx, shard.ShardID, users, groups[shard.ShardID], results, opts)
+		return struct{}{}, nil
+	})
+
+	// A shard skipped because ctx was done never ran, so its users fail here
+	for shardID, err := range fanned.Failed() {
+		for _, i := range groups[shardID] {
+			if results[i].Err == nil {
+				results[i].Err = fmt.Errorf("failed to create user: %w", err)
+			}
+		}
+	}
+
+	failed := 0
+	for i, res := range results {
+		if res.Err != nil {
+			failed++
+			if reserved[i].Acquired {
+				r.releaseEmail(ctx, users[i].Email, users[i].UserID)
+			}
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("failed to create %d of %d users", failed, len(users))
+	}
+
+	return results, nil
+}
+
+// createShardBatch inserts the users at the given indexes, which all route to shardID
+func (r *UserRepository) createShardBatch(ctx context.Context, shardID int, users []*models.User, indexes []int, results []BatchResult, opts BatchOptions) {
+	query := `
+		INSERT INTO users (id, user_id, name, email, created_at)
+		SELECT users_next_id($4), user_id, name, email, CURRENT_TIMESTAMP
+		FROM unnest($1::text[], $2::text[], $3::text[]) AS u(user_id, name, email)
+	`
+	if !opts.AtomicPerShard {
+		query += ` ON CONFLICT (user_id) DO NOTHING`
+	}
+	query += ` RETURNING user_id, name, email, id, created_at, version`
+
+	type created struct {
+		userID    string
+		name      string
+		email     string
+		id        int64
+		createdAt time.Time
+		version   int64
+	}
+
+	// Rows are only applied to the users once the transaction committed,
+	// because a fenced write may be retried against a refreshed topology
+	groupKey := users[indexes[0]].UserID
+
+	var inserted map[string][]created
+	err := r.shardManager.WithWriteTx(ctx, groupKey, func(tx *sharding.ShardTx) error {
+		inserted = make(map[string][]created)
+
+		for start := 0; start < len(indexes); start += opts.ChunkSize {
+			end := min(start+opts.ChunkSize, len(indexes))
+
+			var userIDs, names, emails []string
+			for _, i := range indexes[start:end] {
+				// The topology may have moved users since they were grouped
+				if err := tx.CheckKey(users[i].UserID); err != nil {
+					return err
+				}
+				userIDs = append(userIDs, users[i].UserID)
+				names = append(names, users[i].Name)
+				emails = append(emails, users[i].Email)
+			}
+
+			rows, err := tx.Query(ctx, query, userIDs, names, emails, tx.ShardID)
+			if err != nil {
+				return err
+			}
+
+			var events []outbox.Message
+			for rows.Next() {
+				var c created
+				if err := rows.Scan(&c.userID, &c.name, &c.email, &c.id, &c.createdAt, &c.version); err != nil {
+					rows.Close()
+					return err
+				}
+				inserted[c.userID] = append(inserted[c.userID], c)
+				events = append(events, userEvent(EventUserCreated, &models.User{
+					ID: c.id, UserID: c.userID, Name: c.name, Email: c.email, CreatedAt: c.createdAt, Version: c.version,
+				}))
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			if err := publishUserEvents(ctx, tx, events...); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		for _, i := range indexes {
+			results[i].Err = fmt.Errorf("failed to create user in shard %d: %w", shardID, err)
+		}
+		return
+	}
+
+	// Users skipped by ON CONFLICT are not returned; duplicates within the
+	// batch give the row to the first occurrence
+	for _, i := range indexes {
+		user := users[i]
+		rows := inserted[user.UserID]
+		if len(rows) == 0 {
+			results[i].Err = fmt.Errorf("failed to create user: user %w: %s", sharding.ErrAlreadyExists, user.UserID)
+			continue
+		}
+
+		user.ID = rows[0].id
+		user.CreatedAt = rows[0].createdAt
+		user.Version = rows[0].version
+		inserted[user.UserID] = rows[1:]
+	}
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func batchUsers(prefix string, n int) []*models.User {
+	users := make([]*models.User, n)
+	for i := range users {
+		users[i] = &models.User{
+			UserID: fmt.Sprintf("%s_%d", prefix, i),
+			Name:   fmt.Sprintf("Batch User %d", i),
+			Email:  fmt.Sprintf("%s_%d@example.com", prefix, i),
+		}
+	}
+	return users
+}
+
+func deleteUsers(repo *UserRepository, users []*models.User) {
+	for _, user := range users {
+		_ = repo.Delete(context.Background(), user.UserID)
+	}
+}
+
+func TestUserRepository_CreateBatch(t *testing.T) {
+	repo, sm, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	users := batchUsers("batch_user", 12)
+	defer deleteUsers(repo, users)
+
+	results, err := repo.CreateBatch(ctx, users, BatchOptions{ChunkSize: 2})
+	require.NoError(t, err)
+	require.Len(t, results, len(users))
+
+	shardsUsed := make(map[int]bool)
+	for i, res := range results {
+		assert.NoError(t, res.Err)
+		assert.Same(t, users[i], res.User, "Results should be in input order")
+		assert.NotZero(t, res.User.ID)
+		assert.False(t, res.User.CreatedAt.IsZero())
+		shardsUsed[sm.GetShardID(res.User.UserID)] = true
+	}
+	assert.Greater(t, len(shardsUsed), 1, "Batch should span several shards")
+
+	retrieved, err := repo.GetByUserIDFromPrimary(ctx, users[5].UserID)
+	require.NoError(t, err)
+	assert.Equal(t, users[5].Email, retrieved.Email)
+}
+
+func TestUserRepository_CreateBatch_Duplicates(t *testing.T) {
+	repo, sm, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	existing := batchUsers("batch_dup", 1)[0]
+	require.NoError(t, repo.Create(ctx, existing))
+
+	users := append(batchUsers("batch_dup_new", 6), &models.User{UserID: existing.UserID, Name: "Again", Email: "again@example.com"})
+	defer deleteUsers(repo, append(users, existing))
+
+	// Best effort: only the duplicate fails
+	results, err := repo.CreateBatch(ctx, users, BatchOptions{})
+	require.Error(t, err)
+	for i, res := range results {
+		if i == len(users)-1 {
+			assert.Error(t, res.Err, "Existing user_id should be reported per item")
+		} else {
+			assert.NoError(t, res.Err)
+		}
+	}
+	deleteUsers(repo, users[:len(users)-1])
+
+	// All-or-nothing: every user on the duplicate's shard fails
+	atomicUsers := append(batchUsers("batch_dup_atomic", 6), &models.User{UserID: existing.UserID, Name: "Again", Email: "again@example.com"})
+	defer deleteUsers(repo, atomicUsers[:len(atomicUsers)-1])
+
+	results, err = repo.CreateBatch(ctx, atomicUsers, BatchOptions{AtomicPerShard: true})
+	require.Error(t, err)
+	dupShard := sm.GetShardID(existing.UserID)
+	for _, res := range results {
+		if sm.GetShardID(res.User.UserID) == dupShard {
+			assert.Error(t, res.Err)
+		} else {
+			assert.NoError(t, res.Err)
+		}
+	}
+}
+
+func TestUserRepository_CreateBatch_Cancelled(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	users := batchUsers("batch_cancelled", 6)
+	results, err := repo.CreateBatch(ctx, users, BatchOptions{})
+	require.Error(t, err)
+	for _, res := range results {
+		assert.ErrorIs(t, res.Err, context.Canceled, "Every user of a skipped shard should fail")
+		assert.Zero(t, res.User.ID)
+	}
+}
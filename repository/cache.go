@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+)
+
+// UserCache stores users by user_id for CachedUserRepository
+// A nil user records that the user doesn't exist (negative caching).
+// Implementations must be safe for concurrent use.
+type UserCache interface {
+	// Get returns the cached user, and whether there was an unexpired entry
+	Get(userID string) (user *models.User, found bool)
+	Set(userID string, user *models.User, ttl time.Duration)
+	Delete(userIDs ...string)
+
+	// Clear drops every entry
+	Clear()
+}
+
+// LRUCache is an in-process UserCache bounded by entry count
+// Entries expire after their TTL; when full, the least recently used entry is evicted.
+type LRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+	now      func() time.Time
+}
+
+type lruEntry struct {
+	userID    string
+	user      *models.User
+	expiresAt time.Time
+}
+
+// NewLRUCache creates a cache holding at most capacity users
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{
+		capacity: max(capacity, 1),
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+func (c *LRUCache) Get(userID string) (*models.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[userID]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !c.now().Before(e.expiresAt) {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return e.user, true
+}
+
+func (c *LRUCache) Set(userID string, user *models.User, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(ttl)
+	if el, ok := c.entries[userID]; ok {
+		e := el.Value.(*lruEntry)
+		e.user, e.expiresAt = user, expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[userID] = c.order.PushFront(&lruEntry{userID: userID, user: user, expiresAt: expiresAt})
+	if c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *LRUCache) Delete(userIDs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, userID := range userIDs {
+		if el, ok := c.entries[userID]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *LRUCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+	c.order.Init()
+}
+
+// Len returns the number of entries, including expired ones not yet evicted
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).userID)
+}
@@ -0,0 +1,177 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRUCache(2)
+	c.Set("a", &models.User{UserID: "a"}, time.Minute)
+	c.Set("b", &models.User{UserID: "b"}, time.Minute)
+
+	_, found := c.Get("a") // a is now more recent than b
+	require.True(t, found)
+	c.Set("c", &models.User{UserID: "c"}, time.Minute)
+
+	_, found = c.Get("b")
+	assert.False(t, found)
+	_, found = c.Get("a")
+	assert.True(t, found)
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestLRUCache_Expires(t *testing.T) {
+	now := time.Now()
+	c := NewLRUCache(10)
+	c.now = func() time.Time { return now }
+
+	c.Set("a", &models.User{UserID: "a"}, time.Second)
+	c.Set("missing", nil, time.Minute)
+
+	user, found := c.Get("missing")
+	assert.True(t, found, "Negative entries should be cached")
+	assert.Nil(t, user)
+
+	now = now.Add(2 * time.Second)
+	_, found = c.Get("a")
+	assert.False(t, found)
+	assert.Equal(t, 1, c.Len())
+
+	c.Clear()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestCachedUserRepository_CachesHitsAndMisses(t *testing.T) {
+	r := NewCachedUserRepository(&UserRepository{}, CacheOptions{})
+	var loads atomic.Int32
+	r.load = func(ctx context.Context, userID string) (*models.User, error) {
+		loads.Add(1)
+		if userID == "missing" {
+			return nil, notFound(userID)
+		}
+		return &models.User{UserID: userID}, nil
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		user, err := r.GetByUserID(ctx, "user_1")
+		require.NoError(t, err)
+		assert.Equal(t, "user_1", user.UserID)
+
+		_, err = r.GetByUserID(ctx, "missing")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	}
+	assert.Equal(t, int32(2), loads.Load())
+
+	r.Invalidate("user_1", "missing")
+	r.GetByUserID(ctx, "user_1")
+	r.GetByUserID(ctx, "missing")
+	assert.Equal(t, int32(4), loads.Load())
+}
+
+func TestCachedUserRepository_ReturnsCopies(t *testing.T) {
+	r := NewCachedUserRepository(&UserRepository{}, CacheOptions{})
+	loaded := &models.User{UserID: "user_1", Name: "Original"}
+	r.load = func(ctx context.Context, userID string) (*models.User, error) {
+		return loaded, nil
+	}
+	ctx := context.Background()
+
+	// Editing a miss's result, the loaded row or a hit's result must not reach the cache
+	user, err := r.GetByUserID(ctx, "user_1")
+	require.NoError(t, err)
+	user.Name = "Edited"
+	loaded.Name = "Changed"
+
+	user, err = r.GetByUserID(ctx, "user_1")
+	require.NoError(t, err)
+	assert.Equal(t, "Original", user.Name)
+	user.Name = "Edited"
+
+	user, err = r.GetByUserID(ctx, "user_1")
+	require.NoError(t, err)
+	assert.Equal(t, "Original", user.Name)
+}
+
+func TestCachedUserRepository_CollapsesConcurrentMisses(t *testing.T) {
+	r := NewCachedUserRepository(&UserRepository{}, CacheOptions{})
+	release := make(chan struct{})
+	var loads atomic.Int32
+	r.load = func(ctx context.Context, userID string) (*models.User, error) {
+		loads.Add(1)
+		<-release
+		return &models.User{UserID: userID}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := r.GetByUserID(context.Background(), "hot_user")
+			assert.NoError(t, err)
+			assert.Equal(t, "hot_user", user.UserID)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), loads.Load())
+}
+
+func TestCachedUserRepository_InvalidationDuringLoad(t *testing.T) {
+	r := NewCachedUserRepository(&UserRepository{}, CacheOptions{})
+	r.load = func(ctx context.Context, userID string) (*models.User, error) {
+		// A write lands while the stale row is being read
+		r.Invalidate(userID)
+		return &models.User{UserID: userID, Name: "Stale"}, nil
+	}
+
+	_, err := r.GetByUserID(context.Background(), "user_1")
+	require.NoError(t, err)
+
+	_, found := r.cache.Get("user_1")
+	assert.False(t, found, "A load that raced with an invalidation should not be cached")
+}
+
+// racingCache invalidates the user from another goroutine while a load stores it
+type racingCache struct {
+	*LRUCache
+	invalidate func(userID string)
+	done       chan struct{}
+}
+
+func (c *racingCache) Set(userID string, user *models.User, ttl time.Duration) {
+	go func() {
+		c.invalidate(userID)
+		close(c.done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.LRUCache.Set(userID, user, ttl)
+}
+
+func TestCachedUserRepository_InvalidationDuringStore(t *testing.T) {
+	cache := &racingCache{LRUCache: NewLRUCache(10), done: make(chan struct{})}
+	r := NewCachedUserRepository(&UserRepository{}, CacheOptions{Cache: cache})
+	cache.invalidate = func(userID string) { r.Invalidate(userID) }
+	r.load = func(ctx context.Context, userID string) (*models.User, error) {
+		return &models.User{UserID: userID, Name: "Stale"}, nil
+	}
+
+	_, err := r.GetByUserID(context.Background(), "user_1")
+	require.NoError(t, err)
+	<-cache.done
+
+	_, found := cache.Get("user_1")
+	assert.False(t, found, "An invalidation racing with the store should win")
+}
@@ -0,0 +1,238 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 10 * time.Second
+	defaultCacheSize        = 10000
+)
+
+// CacheOptions configures a CachedUserRepository
+type CacheOptions struct {
+	// Cache stores the users; defaults to an LRUCache of Size entries
+	Cache UserCache
+	Size  int
+
+	// TTL bounds how long a user is served from the cache; defaults to 1 minute
+	TTL time.Duration
+
+	// NegativeTTL bounds how long "user not found" is cached; defaults to 10 seconds
+	NegativeTTL time.Duration
+}
+
+// CachedUserRepository is a UserRepository with a read-through cache in front of GetByUserID
+// Create, Update, Delete and CreateBatch invalidate the users they write, and
+// concurrent misses for the same user share a single query. Writes made by other
+// instances are only seen after the TTL, unless FollowInvalidations is running.
+// Every other method goes straight to the database.
+type CachedUserRepository struct {
+	*UserRepository
+
+	cache UserCache
+	opts  CacheOptions
+	group singleflight.Group
+
+	// load reads a user on a miss; it is the repository's GetByUserIDFromPrimary,
+	// since a lagging replica would cache a row older than the caller's own writes
+	load func(ctx context.Context, userID string) (*models.User, error)
+
+	// mu makes an invalidation and a load's check-and-store of the user atomic
+	mu sync.Mutex
+
+	// generation changes on every invalidation; a load that raced with one is not
+	// cached. Guarded by mu.
+	generation uint64
+}
+
+// NewCachedUserRepository wraps repo with a read-through cache
+func NewCachedUserRepository(repo *UserRepository, opts CacheOptions) *CachedUserRepository {
+	if opts.Size <= 0 {
+		opts.Size = defaultCacheSize
+	}
+	if opts.Cache == nil {
+		opts.Cache = NewLRUCache(opts.Size)
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCacheTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultCacheNegativeTTL
+	}
+
+	return &CachedUserRepository{
+		UserRepository: repo,
+		cache:          opts.Cache,
+		opts:           opts,
+		load:           repo.GetByUserIDFromPrimary,
+	}
+}
+
+// GetByUserID returns the cached user, or reads it from the primary and caches it
+// Users that don't exist are cached too, for NegativeTTL.
+// Every caller gets its own copy, which it may modify and pass to Update.
+func (r *CachedUserRepository) GetByUserID(ctx context.Context, userID string) (*models.User, error) {
+	if user, found := r.cache.Get(userID); found {
+		if user == nil {
+			return nil, notFound(userID)
+		}
+		return cloneUser(user), nil
+	}
+
+	ch := r.group.DoChan(userID, func() (any, error) {
+		r.mu.Lock()
+		generation := r.generation
+		r.mu.Unlock()
+
+		// The query is shared, so it must not fail because the first caller gave up
+		user, err := r.load(context.WithoutCancel(ctx), userID)
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+
+		r.store(userID, user, generation)
+		return user, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		// The result is shared by every caller of the flight
+		if user := res.Val.(*models.User); user != nil {
+			return cloneUser(user), nil
+		}
+		return nil, notFound(userID)
+	}
+}
+
+// store caches a loaded user, or its absence, unless an invalidation happened
+// since generation. An invalidation can't land between the check and the Set.
+func (r *CachedUserRepository) store(userID string, user *models.User, generation uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.generation != generation {
+		return
+	}
+	if user == nil {
+		r.cache.Set(userID, nil, r.opts.NegativeTTL)
+	} else {
+		r.cache.Set(userID, cloneUser(user), r.opts.TTL)
+	}
+}
+
+// Create creates the user and drops any cached "not found" for it
+func (r *CachedUserRepository) Create(ctx context.Context, user *models.User) error {
+	defer r.Invalidate(user.UserID)
+	return r.UserRepository.Create(ctx, user)
+}
+
+// Update updates the user and drops it from the cache
+func (r *CachedUserRepository) Update(ctx context.Context, user *models.User) error {
+	defer r.Invalidate(user.UserID)
+	return r.UserRepository.Update(ctx, user)
+}
+
+// CreateIdempotent is Create guarded by an idempotency key (see UserRepository.CreateIdempotent)
+func (r *CachedUserRepository) CreateIdempotent(ctx context.Context, key string, user *models.User) error {
+	defer r.Invalidate(user.UserID)
+	return r.UserRepository.CreateIdempotent(ctx, key, user)
+}
+
+// UpdateIdempotent is Update guarded by an idempotency key (see UserRepository.UpdateIdempotent)
+func (r *CachedUserRepository) UpdateIdempotent(ctx context.Context, key string, user *models.User) error {
+	defer r.Invalidate(user.UserID)
+	return r.UserRepository.UpdateIdempotent(ctx, key, user)
+}
+
+// Upsert creates or overwrites the user and drops it from the cache
+func (r *CachedUserRepository) Upsert(ctx context.Context, user *models.User) (bool, error) {
+	defer r.Invalidate(user.UserID)
+	return r.UserRepository.Upsert(ctx, user)
+}
+
+// Patch patches the user and drops it from the cache
+func (r *CachedUserRepository) Patch(ctx context.Context, userID string, fields UserPatch) (*models.User, error) {
+	defer r.Invalidate(userID)
+	return r.UserRepository.Patch(ctx, userID, fields)
+}
+
+// Delete deletes the user and drops it from the cache
+func (r *CachedUserRepository) Delete(ctx context.Context, userID string) error {
+	defer r.Invalidate(userID)
+	return r.UserRepository.Delete(ctx, userID)
+}
+
+// CreateBatch creates the users and drops any cached "not found" for them
+func (r *CachedUserRepository) CreateBatch(ctx context.Context, users []*models.User, opts BatchOptions) ([]BatchResult, error) {
+	userIDs := make([]string, len(users))
+	for i, user := range users {
+		userIDs[i] = user.UserID
+	}
+	defer r.Invalidate(userIDs...)
+
+	return r.UserRepository.CreateBatch(ctx, users, opts)
+}
+
+// Invalidate drops users from the cache
+func (r *CachedUserRepository) Invalidate(userIDs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.generation++
+	r.cache.Delete(userIDs...)
+}
+
+// InvalidateAll empties the cache
+func (r *CachedUserRepository) InvalidateAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.generation++
+	r.cache.Clear()
+}
+
+// FollowInvalidations applies the listener's invalidations to the cache until ctx is cancelled
+// so writes made by other instances are seen right away. A resync empties the
+// whole cache, as entries are not tracked by shard.
+func (r *CachedUserRepository) FollowInvalidations(ctx context.Context, listener *sharding.InvalidationListener) {
+	invalidations, unsubscribe := listener.Subscribe(1024)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case inv := <-invalidations:
+			if inv.Resync {
+				r.InvalidateAll()
+			} else {
+				r.Invalidate(inv.Key)
+			}
+		}
+	}
+}
+
+func notFound(userID string) error {
+	return fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+}
+
+// cloneUser copies a user so the cache and its callers never share one
+func cloneUser(user *models.User) *models.User {
+	clone := *user
+	return &clone
+}
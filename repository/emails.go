@@ -0,0 +1,268 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// emailScope names the email column in the unique_reservations table
+const emailScope = "email"
+
+// defaultIndexBatchSize is the number of users checked per round trip by VerifyEmailIndex
+const defaultIndexBatchSize = 500
+
+// normalizeEmail returns the form emails are compared in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// GetByEmail retrieves a user by email without querying every shard
+// The email reservations double as a global index from email to user_id, so
+// this is two point lookups on replicas: the email's shard, then the user's shard.
+func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	userID, found, err := r.emails.Lookup(ctx, normalizeEmail(email))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, email)
+	}
+
+	user, err := r.GetByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entry may be orphaned, or the user may have moved off the email
+	if normalizeEmail(user.Email) != normalizeEmail(email) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, email)
+	}
+
+	return user, nil
+}
+
+// releaseEmail releases a reservation after the owner's write failed or moved off the email
+// A failed release only leaves an orphan for the cleanup job, so it is logged, not returned
+func (r *UserRepository) releaseEmail(ctx context.Context, email, userID string) {
+	if err := r.emails.Release(context.WithoutCancel(ctx), normalizeEmail(email), userID); err != nil {
+		log.Printf("failed to release email reservation for user %s: %v", userID, err)
+	}
+}
+
+// CleanupEmailReservations removes email reservations whose user no longer exists
+// or no longer has that email, and returns how many it removed. Reservations
+// younger than minAge belong to writes that may still be in flight and are kept.
+func (r *UserRepository) CleanupEmailReservations(ctx context.Context, minAge time.Duration) (int, error) {
+	return r.emails.Cleanup(ctx, minAge, r.emailsInUse)
+}
+
+// RunEmailReservationCleanup calls CleanupEmailReservations every interval until ctx is cancelled
+func (r *UserRepository) RunEmailReservationCleanup(ctx context.Context, interval, minAge time.Duration) {
+	r.emails.RunCleanup(ctx, interval, minAge, r.emailsInUse)
+}
+
+// emailsInUse reports which reservations are backed by their owner's current email
+// Owners are looked up on the primaries so a lagging replica can't make a fresh
+// reservation look orphaned.
+func (r *UserRepository) emailsInUse(ctx context.Context, rs []sharding.Reservation) ([]bool, error) {
+	groups := make(map[int][]string)
+	for _, res := range rs {
+		shardID := r.shardManager.GetShardID(res.Owner)
+		groups[shardID] = append(groups[shardID], res.Owner)
+	}
+
+	query := `SELECT user_id, email FROM users WHERE user_id = ANY($1)`
+
+	emails := make(map[string]string)
+	for shardID, userIDs := range groups {
+		shard, err := r.shardManager.GetShardByID(shardID)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := shard.PrimaryQuerier().Query(ctx, query, userIDs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query shard %d: %w", shardID, err)
+		}
+
+		for rows.Next() {
+			var userID, email string
+			if err := rows.Scan(&userID, &email); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan user from shard %d: %w", shardID, err)
+			}
+			emails[userID] = normalizeEmail(email)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating rows from shard %d: %w", shardID, err)
+		}
+	}
+
+	used := make([]bool, len(rs))
+	for i, res := range rs {
+		email, ok := emails[res.Owner]
+		used[i] = ok && email == res.Value
+	}
+
+	return used, nil
+}
+
+// IndexCheckOptions configures VerifyEmailIndex
+type IndexCheckOptions struct {
+	// Repair adds missing entries and removes orphaned ones
+	// Conflicts (two users with the same email) are only reported.
+	Repair bool
+
+	// MinAge skips entries younger than this when looking for orphans,
+	// so writes in flight are not mistaken for drift
+	MinAge time.Duration
+
+	// BatchSize is the number of users checked per round trip; defaults to 500
+	BatchSize int
+}
+
+// IndexReport describes the drift found between the users tables and the email index
+type IndexReport struct {
+	// Users is the number of users checked
+	Users int
+
+	// Missing are users whose email has no entry
+	Missing []sharding.Reservation
+
+	// Conflicts are users whose email is indexed to another user
+	Conflicts []sharding.Reservation
+
+	// Orphans are entries not backed by a user with that email
+	Orphans []sharding.Reservation
+
+	// Repaired is the number of entries added or removed
+	Repaired int
+}
+
+// Consistent reports whether no drift was found
+func (rep *IndexReport) Consistent() bool {
+	return len(rep.Missing) == 0 && len(rep.Conflicts) == 0 && len(rep.Orphans) == 0
+}
+
+// VerifyEmailIndex compares the email index with the users tables
+// Every shard primary's users are walked in user_id order and checked against the
+// index, then the index is checked for orphans. With Repair set the drift is fixed;
+// running it on an index that never existed rebuilds it.
+func (r *UserRepository) VerifyEmailIndex(ctx context.Context, opts IndexCheckOptions) (*IndexReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultIndexBatchSize
+	}
+
+	query := `
+		SELECT user_id, email
+		FROM users
+		WHERE user_id > $1
+		ORDER BY user_id
+		LIMIT $2
+	`
+
+	rep := &IndexReport{}
+	for _, shard := range r.shardManager.GetAllShards() {
+		after := ""
+		for {
+			var batch []sharding.Reservation
+			rows, err := shard.PrimaryQuerier().Query(ctx, query, after, opts.BatchSize)
+			if err != nil {
+				return rep, fmt.Errorf("failed to query shard %d: %w", shard.ShardID, err)
+			}
+			for rows.Next() {
+				var userID, email string
+				if err := rows.Scan(&userID, &email); err != nil {
+					rows.Close()
+					return rep, fmt.Errorf("failed to scan user from shard %d: %w", shard.ShardID, err)
+				}
+				batch = append(batch, sharding.Reservation{Value: normalizeEmail(email), Owner: userID})
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return rep, fmt.Errorf("error iterating rows from shard %d: %w", shard.ShardID, err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := r.checkEmailEntries(ctx, batch, opts.Repair, rep); err != nil {
+				return rep, err
+			}
+
+			rep.Users += len(batch)
+			after = batch[len(batch)-1].Owner
+			if len(batch) < opts.BatchSize {
+				break
+			}
+		}
+	}
+
+	orphans, err := r.emails.Orphans(ctx, opts.MinAge, r.emailsInUse)
+	if err != nil {
+		return rep, fmt.Errorf("failed to find orphaned entries: %w", err)
+	}
+	rep.Orphans = orphans
+
+	if opts.Repair && len(orphans) > 0 {
+		removed, err := r.emails.Cleanup(ctx, opts.MinAge, r.emailsInUse)
+		rep.Repaired += removed
+		if err != nil {
+			return rep, err
+		}
+	}
+
+	return rep, nil
+}
+
+// checkEmailEntries checks one batch of users against the index and records the drift
+func (r *UserRepository) checkEmailEntries(ctx context.Context, batch []sharding.Reservation, repair bool, rep *IndexReport) error {
+	values := make([]string, len(batch))
+	for i, entry := range batch {
+		values[i] = entry.Value
+	}
+
+	owners, err := r.emails.Owners(ctx, values)
+	if err != nil {
+		return err
+	}
+
+	var missing []sharding.Reservation
+	for _, entry := range batch {
+		owner, ok := owners[entry.Value]
+		switch {
+		case !ok:
+			missing = append(missing, entry)
+		case owner != entry.Owner:
+			rep.Conflicts = append(rep.Conflicts, entry)
+		}
+	}
+	rep.Missing = append(rep.Missing, missing...)
+
+	if !repair || len(missing) == 0 {
+		return nil
+	}
+
+	for i, res := range r.emails.ReserveMany(ctx, missing) {
+		var taken *sharding.UniqueViolationError
+		switch {
+		case errors.As(res.Err, &taken):
+			// Two users without entries share the email; the first one keeps it
+			rep.Conflicts = append(rep.Conflicts, missing[i])
+		case res.Err != nil:
+			return res.Err
+		case res.Acquired:
+			rep.Repaired++
+		}
+	}
+
+	return nil
+}
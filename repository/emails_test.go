@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	assert.Equal(t, "john@example.com", normalizeEmail("  John@Example.COM "))
+}
+
+func TestUserRepository_EmailUniqueness(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	first := &models.User{UserID: "email_user_1", Name: "First", Email: "unique@example.com"}
+	require.NoError(t, repo.Create(ctx, first))
+	defer repo.Delete(ctx, first.UserID)
+
+	// Same email, different case, on whichever shard the second user lands
+	second := &models.User{UserID: "email_user_2", Name: "Second", Email: "Unique@Example.com"}
+	err := repo.Create(ctx, second)
+	require.Error(t, err)
+	var taken *sharding.UniqueViolationError
+	require.ErrorAs(t, err, &taken)
+	assert.Equal(t, first.UserID, taken.Owner)
+
+	// Moving the first user to another email frees the old one
+	first.Email = "moved@example.com"
+	require.NoError(t, repo.Update(ctx, first))
+	require.NoError(t, repo.Create(ctx, second))
+	defer repo.Delete(ctx, second.UserID)
+
+	// Keeping the same email is not a conflict with yourself
+	first.Name = "First Renamed"
+	require.NoError(t, repo.Update(ctx, first))
+
+	second.Email = first.Email
+	assert.Error(t, repo.Update(ctx, second))
+}
+
+func TestUserRepository_CleanupEmailReservations(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "email_user_3", Name: "Kept", Email: "kept@example.com"}
+	require.NoError(t, repo.Create(ctx, user))
+	defer repo.Delete(ctx, user.UserID)
+
+	// Simulate a create that crashed after reserving
+	_, err := repo.emails.Reserve(ctx, "orphan@example.com", "email_user_missing")
+	require.NoError(t, err)
+
+	removed, err := repo.CleanupEmailReservations(ctx, 0)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, removed, 1)
+
+	// The orphan is gone, the live reservation is kept
+	orphan := &models.User{UserID: "email_user_4", Name: "Orphan", Email: "orphan@example.com"}
+	require.NoError(t, repo.Create(ctx, orphan))
+	defer repo.Delete(ctx, orphan.UserID)
+
+	dup := &models.User{UserID: "email_user_5", Name: "Dup", Email: "kept@example.com"}
+	assert.Error(t, repo.Create(ctx, dup))
+}
+
+func TestUserRepository_GetByEmail(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "email_user_6", Name: "Indexed", Email: "indexed@example.com"}
+	require.NoError(t, repo.Create(ctx, user))
+	defer repo.Delete(ctx, user.UserID)
+
+	// Wait for replication
+	time.Sleep(200 * time.Millisecond)
+
+	found, err := repo.GetByEmail(ctx, "Indexed@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, user.UserID, found.UserID)
+
+	_, err = repo.GetByEmail(ctx, "nobody@example.com")
+	assert.Error(t, err)
+}
+
+func TestUserRepository_VerifyEmailIndex(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "email_user_7", Name: "Drifted", Email: "drifted@example.com"}
+	require.NoError(t, repo.Create(ctx, user))
+	defer repo.Delete(ctx, user.UserID)
+
+	// Drop the user's entry behind the repository's back
+	require.NoError(t, repo.emails.Release(ctx, "drifted@example.com", user.UserID))
+
+	rep, err := repo.VerifyEmailIndex(ctx, IndexCheckOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, rep.Missing, sharding.Reservation{Value: "drifted@example.com", Owner: user.UserID})
+
+	rep, err = repo.VerifyEmailIndex(ctx, IndexCheckOptions{Repair: true})
+	require.NoError(t, err)
+	assert.Positive(t, rep.Repaired)
+
+	rep, err = repo.VerifyEmailIndex(ctx, IndexCheckOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, rep.Missing, sharding.Reservation{Value: "drifted@example.com", Owner: user.UserID})
+}
@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/outbox"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// Event types published through the outbox; every payload is the user as JSON
+// (for user.deleted, as it was before the delete)
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+func userEvent(eventType string, user *models.User) outbox.Message {
+	return outbox.Message{AggregateID: user.UserID, Type: eventType, Payload: user}
+}
+
+// publishUserEvents records user changes inside the write transaction: the
+// events go to the shard's outbox and the user IDs are announced on the
+// shard's invalidation channel, both taking effect only if the transaction commits
+func publishUserEvents(ctx context.Context, tx *sharding.ShardTx, events ...outbox.Message) error {
+	if err := outbox.Append(ctx, tx, events...); err != nil {
+		return err
+	}
+
+	userIDs := make([]string, len(events))
+	for i, e := range events {
+		userIDs[i] = e.AggregateID
+	}
+	return tx.NotifyInvalidation(ctx, userIDs...)
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// DefaultIdempotencyKeyTTL is how long idempotency keys are usually kept before
+// PurgeIdempotencyKeys removes them; clients must not retry for longer
+const DefaultIdempotencyKeyTTL = 24 * time.Hour
+
+// ErrIdempotencyKeyReused is wrapped by the errors of writes whose idempotency key
+// was already used for a different request of the same user. Keys are scoped
+// to a user: the same key for another user is another key. It matches
+// sharding.ErrConflict too.
+var ErrIdempotencyKeyReused = fmt.Errorf("idempotency key reused: %w", sharding.ErrConflict)
+
+// Operations recorded with idempotency keys
+const (
+	opCreate = "create"
+	opUpdate = "update"
+)
+
+// requestHash fingerprints a write so a reused key can be told from a replay
+// Only the fields the client sends count: a create ignores the version, which
+// the first attempt may already have filled in.
+func requestHash(op string, user *models.User) string {
+	var version int64
+	if op == opUpdate {
+		version = user.Version
+	}
+
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%s\x00%s\x00%s\x00%d", op, user.UserID, user.Name, user.Email, version))
+	return hex.EncodeToString(sum[:])
+}
+
+// findReplay returns the stored result if key was already used for this write
+// of user, or nil if the key is unknown or its first use hasn't committed yet.
+// Writes call it before reserving anything, so that a replay has no side
+// effects even if the user changed since; the claim in the write's transaction
+// still settles races between concurrent uses of the key.
+func (r *UserRepository) findReplay(ctx context.Context, key, op string, user *models.User) (*models.User, error) {
+	var storedHash string
+	var response []byte
+	err := r.shardManager.ReadPrimary(ctx, user.UserID, func(db sharding.Querier) error {
+		return db.QueryRow(ctx, `
+			SELECT request_hash, response FROM idempotency_keys
+			WHERE user_id = $1 AND key = $2 AND response IS NOT NULL
+		`, user.UserID, key).Scan(&storedHash, &response)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+
+	return replayed(key, requestHash(op, user), storedHash, response)
+}
+
+// claimIdempotencyKey records key for the write of user inside its transaction
+// It returns nil if the key is new: the caller runs the write and then
+// saveIdempotentResult. If the key was used by the same request, it returns the
+// user that request stored, and the caller must not write. A concurrent request
+// with the same key waits here until the first one commits or rolls back.
+func claimIdempotencyKey(ctx context.Context, tx *sharding.ShardTx, key, op string, user *models.User) (*models.User, error) {
+	hash := requestHash(op, user)
+
+	claimed, err := tx.Exec(ctx, `
+		INSERT INTO idempotency_keys (user_id, key, operation, request_hash)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO NOTHING
+	`, user.UserID, key, op, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if claimed == 1 {
+		return nil, nil
+	}
+
+	var storedHash string
+	var response []byte
+	err = tx.QueryRow(ctx, `SELECT request_hash, response FROM idempotency_keys WHERE user_id = $1 AND key = $2`,
+		user.UserID, key).Scan(&storedHash, &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+
+	return replayed(key, hash, storedHash, response)
+}
+
+// replayed checks that a used key was used for the same request and decodes its result
+func replayed(key, hash, storedHash string, response []byte) (*models.User, error) {
+	if storedHash != hash {
+		return nil, fmt.Errorf("%w: %s", ErrIdempotencyKeyReused, key)
+	}
+
+	var stored models.User
+	if err := json.Unmarshal(response, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode result of idempotency key %s: %w", key, err)
+	}
+	return &stored, nil
+}
+
+// saveIdempotentResult stores the result of the write that claimed key, for replays to return
+func saveIdempotentResult(ctx context.Context, tx *sharding.ShardTx, key string, user *models.User) error {
+	response, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to encode result of idempotency key %s: %w", key, err)
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE idempotency_keys SET response = $3 WHERE user_id = $1 AND key = $2`,
+		user.UserID, key, response)
+	if err != nil {
+		return fmt.Errorf("failed to save result of idempotency key %s: %w", key, err)
+	}
+	return nil
+}
+
+// PurgeIdempotencyKeys removes idempotency keys older than maxAge from every shard
+// and returns how many it removed. Replaying an older key runs the write again.
+func (r *UserRepository) PurgeIdempotencyKeys(ctx context.Context, maxAge time.Duration) (int, error) {
+	query := `DELETE FROM idempotency_keys WHERE created_at < CURRENT_TIMESTAMP - make_interval(secs => $1)`
+
+	removed := 0
+	for _, shard := range r.shardManager.GetAllShards() {
+		n, err := shard.PrimaryQuerier().Exec(ctx, query, maxAge.Seconds())
+		if err != nil {
+			return removed, fmt.Errorf("failed to purge idempotency keys on shard %d: %w", shard.ShardID, err)
+		}
+		removed += int(n)
+	}
+
+	return removed, nil
+}
+
+// RunIdempotencyKeyPurge calls PurgeIdempotencyKeys every interval until ctx is cancelled
+func (r *UserRepository) RunIdempotencyKeyPurge(ctx context.Context, interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := r.PurgeIdempotencyKeys(ctx, maxAge)
+		if err != nil {
+			log.Printf("idempotency key purge failed: %v", err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("purged %d expired idempotency keys", removed)
+		}
+	}
+}
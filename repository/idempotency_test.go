@@ -0,0 +1,110 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestHash(t *testing.T) {
+	user := &models.User{UserID: "u1", Name: "Ann", Email: "ann@example.com"}
+
+	// A create's retry may carry the version its first attempt filled in
+	created := *user
+	created.Version = 1
+	assert.Equal(t, requestHash(opCreate, user), requestHash(opCreate, &created))
+
+	// An update is for a given version
+	assert.NotEqual(t, requestHash(opUpdate, user), requestHash(opUpdate, &created))
+
+	assert.NotEqual(t, requestHash(opCreate, user), requestHash(opUpdate, user))
+	renamed := *user
+	renamed.Name = "Bob"
+	assert.NotEqual(t, requestHash(opCreate, user), requestHash(opCreate, &renamed))
+}
+
+func TestUserRepository_Idempotency(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	suffix := time.Now().UnixNano()
+	createKey, updateKey := fmt.Sprintf("create-%d", suffix), fmt.Sprintf("update-%d", suffix)
+
+	user := &models.User{UserID: "idem_user", Name: "Original", Email: "idem@example.com"}
+	require.NoError(t, repo.CreateIdempotent(ctx, createKey, user))
+
+	// The replay returns the created user instead of a duplicate error
+	replay := &models.User{UserID: "idem_user", Name: "Original", Email: "idem@example.com"}
+	require.NoError(t, repo.CreateIdempotent(ctx, createKey, replay))
+	assert.Equal(t, user.ID, replay.ID)
+	assert.Equal(t, user.Version, replay.Version)
+
+	// The same key for another request is refused
+	err := repo.CreateIdempotent(ctx, createKey, &models.User{UserID: "idem_user", Name: "Other", Email: "idem@example.com"})
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	assert.ErrorIs(t, err, sharding.ErrConflict)
+
+	// An update applies once, however many times it is sent
+	edit := *user
+	edit.Name = "Edited"
+	first, second := edit, edit
+	require.NoError(t, repo.UpdateIdempotent(ctx, updateKey, &first))
+	require.NoError(t, repo.UpdateIdempotent(ctx, updateKey, &second))
+	assert.Equal(t, int64(2), first.Version)
+	assert.Equal(t, first.Version, second.Version)
+	assert.Equal(t, "Edited", second.Name)
+
+	current, err := repo.GetByUserIDFromPrimary(ctx, user.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), current.Version)
+
+	// Purged keys are forgotten
+	removed, err := repo.PurgeIdempotencyKeys(ctx, 0)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, removed, 2)
+}
+
+func TestUserRepository_IdempotentReplayAfterEmailChange(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	key := fmt.Sprintf("create-%d", time.Now().UnixNano())
+
+	user := &models.User{UserID: "idem_user", Name: "Original", Email: "idem_old@example.com"}
+	require.NoError(t, repo.CreateIdempotent(ctx, key, user))
+
+	// The user moves to a new email and someone else takes the old one
+	moved := *user
+	moved.Email = "idem_new@example.com"
+	require.NoError(t, repo.Update(ctx, &moved))
+	require.NoError(t, repo.Create(ctx, &models.User{UserID: "idem_user_2", Name: "Other", Email: "idem_old@example.com"}))
+
+	// The late replay still returns the original result and reserves nothing
+	replay := &models.User{UserID: "idem_user", Name: "Original", Email: "idem_old@example.com"}
+	require.NoError(t, repo.CreateIdempotent(ctx, key, replay))
+	assert.Equal(t, user.ID, replay.ID)
+	assert.Equal(t, int64(1), replay.Version)
+
+	// Wait for replication before reading the email index
+	time.Sleep(200 * time.Millisecond)
+
+	owner, err := repo.GetByEmail(ctx, "idem_old@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "idem_user_2", owner.UserID)
+	owner, err = repo.GetByEmail(ctx, "idem_new@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "idem_user", owner.UserID)
+
+	// The key belongs to idem_user; another user's request with it is a new request
+	other := &models.User{UserID: "idem_user_2", Name: "Other", Email: "idem_other@example.com", Version: 1}
+	require.NoError(t, repo.UpdateIdempotent(ctx, key, other))
+	assert.Equal(t, int64(2), other.Version)
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// GetByUserIDs retrieves many users with one query per shard
+// The IDs are bucketed by shard and every shard is queried concurrently on a
+// replica with WHERE user_id = ANY($1). Found users are returned in input order;
+// IDs that don't exist are returned in missing instead of causing an error.
+func (r *UserRepository) GetByUserIDs(ctx context.Context, userIDs []string) (users []*models.User, missing []string, err error) {
+	groups := make(map[int][]string)
+	for _, userID := range userIDs {
+		shardID := r.shardManager.GetShardID(userID)
+		groups[shardID] = append(groups[shardID], userID)
+	}
+
+	var shards []*sharding.Shard
+	for shardID := range groups {
+		shard, err := r.shardManager.GetShardByID(shardID)
+		if err != nil {
+			return nil, nil, err
+		}
+		shards = append(shards, shard)
+	}
+
+	query := `
+		SELECT id, user_id, name, email, created_at, version
+		FROM users
+		WHERE user_id = ANY($1)
+	`
+
+	result, err := sharding.FanOut(ctx, shards, r.fanOut,
+		func(ctx context.Context, shard *sharding.Shard) ([]*models.User, error) {
+			// Read from replicas to reduce load on primary
+			var found []*models.User
+			err := r.shardManager.ReadShardReplica(ctx, shard, func(db sharding.Querier) error {
+				var err error
+				found, err = queryUsers(ctx, db, query, groups[shard.ShardID])
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to query users: %w", err)
+			}
+
+			return found, nil
+		})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	byID := make(map[string]*models.User, len(userIDs))
+	for _, res := range result.Results {
+		for _, user := range res.Value {
+			byID[user.UserID] = user
+		}
+	}
+
+	for _, userID := range userIDs {
+		if user, ok := byID[userID]; ok {
+			users = append(users, user)
+		} else {
+			missing = append(missing, userID)
+		}
+	}
+
+	return users, missing, nil
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserRepository_GetByUserIDs(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	users := batchUsers("multi_get", 9)
+	defer deleteUsers(repo, users)
+
+	_, err := repo.CreateBatch(ctx, users, BatchOptions{})
+	require.NoError(t, err)
+
+	// Wait for replication
+	time.Sleep(200 * time.Millisecond)
+
+	ids := []string{users[4].UserID, "multi_get_missing_1", users[0].UserID, users[8].UserID, "multi_get_missing_2", users[2].UserID}
+
+	found, missing, err := repo.GetByUserIDs(ctx, ids)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"multi_get_missing_1", "multi_get_missing_2"}, missing)
+
+	require.Len(t, found, 4)
+	assert.Equal(t, users[4].UserID, found[0].UserID, "Users should come back in input order")
+	assert.Equal(t, users[0].UserID, found[1].UserID)
+	assert.Equal(t, users[8].UserID, found[2].UserID)
+	assert.Equal(t, users[2].UserID, found[3].UserID)
+	assert.Equal(t, users[8].Email, found[2].Email)
+
+	found, missing, err = repo.GetByUserIDs(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+	assert.Empty(t, missing)
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"container/heap"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// MaxPageSize caps the limit accepted by ListUsers
+const MaxPageSize = 1000
+
+// UserPage is one page of a cross-shard listing
+type UserPage struct {
+	Users []*models.User
+
+	// NextCursor resumes the listing after this page; empty when there are no more users
+	NextCursor string
+}
+
+// shardPosition is the last row a shard contributed to a previous page
+type shardPosition struct {
+	CreatedAt time.Time `json:"t"`
+	ID        int64     `json:"i"`
+	Done      bool      `json:"d,omitempty"`
+}
+
+// pageCursor is the decoded form of an opaque cursor
+type pageCursor struct {
+	NumShards int                   `json:"n"`
+	Positions map[int]shardPosition `json:"p"`
+}
+
+func encodeCursor(c *pageCursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	c := &pageCursor{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+	return c, nil
+}
+
+// ListUsers returns one page of users across all shards, newest first
+// ORDER BY and LIMIT are pushed down to every shard and the per-shard results
+// are merged with a heap, so pages are globally ordered by (created_at, id).
+// Pass an empty cursor for the first page and UserPage.NextCursor afterwards;
+// the cursor records each shard's position, so pages stay stable while users are added.
+func (r *UserRepository) ListUsers(ctx context.Context, cursor string, limit int) (*UserPage, error) {
+	if limit <= 0 || limit > MaxPageSize {
+		return nil, fmt.Errorf("limit must be between 1 and %d, got %d", MaxPageSize, limit)
+	}
+
+	shards := r.shardManager.GetAllShards()
+
+	pos := &pageCursor{NumShards: len(shards), Positions: make(map[int]shardPosition)}
+	if cursor != "" {
+		var err error
+		pos, err = decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if pos.NumShards != len(shards) {
+			return nil, fmt.Errorf("cursor was created for %d shards, cluster has %d", pos.NumShards, len(shards))
+		}
+	}
+
+	result, err := sharding.FanOut(ctx, shards, r.fanOut,
+		func(ctx context.Context, shard *sharding.Shard) ([]*models.User, error) {
+			p, ok := pos.Positions[shard.ShardID]
+			if ok && p.Done {
+				return nil, nil
+			}
+
+			var after *shardPosition
+			if ok {
+				after = &p
+			}
+			var users []*models.User
+			err := r.shardManager.ReadShardReplica(ctx, shard, func(db sharding.Querier) error {
+				var err error
+				users, err = listShardUsers(ctx, db, after, limit)
+				return err
+			})
+			return users, err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	// Merge the per-shard streams
+	h := &userHeap{}
+	fetched := make(map[int]int)
+	for _, res := range result.Results {
+		fetched[res.ShardID] = len(res.Value)
+		if len(res.Value) > 0 {
+			h.push(&shardStream{shardID: res.ShardID, users: res.Value})
+		}
+	}
+
+	page := &UserPage{}
+	taken := make(map[int]int)
+	for len(page.Users) < limit && h.Len() > 0 {
+		shardID, user := h.pop()
+		page.Users = append(page.Users, user)
+		taken[shardID]++
+		pos.Positions[shardID] = shardPosition{CreatedAt: user.CreatedAt, ID: user.ID}
+	}
+
+	// A shard is done once it returned fewer rows than asked for and all of them were used
+	more := false
+	for _, shard := range shards {
+		p, ok := pos.Positions[shard.ShardID]
+		if ok && p.Done {
+			continue
+		}
+
+		n := fetched[shard.ShardID]
+		if n < limit && taken[shard.ShardID] == n {
+			p.Done = true
+			pos.Positions[shard.ShardID] = p
+			continue
+		}
+		more = true
+	}
+
+	if more {
+		page.NextCursor, err = encodeCursor(pos)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode cursor: %w", err)
+		}
+	}
+
+	return page, nil
+}
+
+// listShardUsers fetches up to limit users of one shard that sort after the given position
+func listShardUsers(ctx context.Context, db sharding.Querier, after *shardPosition, limit int) ([]*models.User, error) {
+	var (
+		rows sharding.Rows
+		err  error
+	)
+
+	if after == nil {
+		rows, err = db.Query(ctx, `
+			SELECT id, user_id, name, email, created_at, version
+			FROM users
+			ORDER BY created_at DESC, id DESC
+			LIMIT $1
+		`, limit)
+	} else {
+		rows, err = db.Query(ctx, `
+			SELECT id, user_id, name, email, created_at, version
+			FROM users
+			WHERE (created_at, id) < ($1, $2)
+			ORDER BY created_at DESC, id DESC
+			LIMIT $3
+		`, after.CreatedAt, after.ID, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// shardStream is the not yet merged part of one shard's ordered results
+type shardStream struct {
+	shardID int
+	users   []*models.User
+}
+
+// userHeap merges ordered per-shard streams into one stream ordered
+// by created_at DESC, id DESC; ties across shards go to the lower shard ID
+type userHeap []*shardStream
+
+func (h userHeap) Len() int { return len(h) }
+
+func (h userHeap) Less(i, j int) bool {
+	a, b := h[i].users[0], h[j].users[0]
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	if a.ID != b.ID {
+		return a.ID > b.ID
+	}
+	return h[i].shardID < h[j].shardID
+}
+
+func (h userHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *userHeap) Push(x any) { *h = append(*h, x.(*shardStream)) }
+
+func (h *userHeap) Pop() any {
+	old := *h
+	n := len(old)
+	s := old[n-1]
+	*h = old[:n-1]
+	return s
+}
+
+func (h *userHeap) push(s *shardStream) {
+	heap.Push(h, s)
+}
+
+// pop removes the next user in merge order
+func (h *userHeap) pop() (int, *models.User) {
+	s := (*h)[0]
+	user := s.users[0]
+	s.users = s.users[1:]
+
+	if len(s.users) == 0 {
+		heap.Pop(h)
+	} else {
+		heap.Fix(h, 0)
+	}
+
+	return s.shardID, user
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	c := &pageCursor{
+		NumShards: 3,
+		Positions: map[int]shardPosition{
+			0: {CreatedAt: at, ID: 42},
+			2: {Done: true},
+		},
+	}
+
+	encoded, err := encodeCursor(c)
+	require.NoError(t, err)
+
+	decoded, err := decodeCursor(encoded)
+	require.NoError(t, err)
+	assert.Equal(t, 3, decoded.NumShards)
+	assert.True(t, at.Equal(decoded.Positions[0].CreatedAt))
+	assert.Equal(t, int64(42), decoded.Positions[0].ID)
+	assert.True(t, decoded.Positions[2].Done)
+
+	_, err = decodeCursor("not a cursor!")
+	assert.Error(t, err)
+}
+
+func TestUserHeap_MergeOrder(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	user := func(minutes int, id int64) *models.User {
+		return &models.User{ID: id, CreatedAt: base.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	h := &userHeap{}
+	h.push(&shardStream{shardID: 0, users: []*models.User{user(9, 3), user(5, 2), user(1, 1)}})
+	h.push(&shardStream{shardID: 1, users: []*models.User{user(8, 7), user(5, 6)}})
+	h.push(&shardStream{shardID: 2, users: []*models.User{user(5, 2)}})
+
+	var order []int
+	var shards []int
+	for h.Len() > 0 {
+		shardID, u := h.pop()
+		order = append(order, int(u.CreatedAt.Sub(base).Minutes()))
+		shards = append(shards, shardID)
+	}
+
+	assert.Equal(t, []int{9, 8, 5, 5, 5, 1}, order)
+	// Equal timestamps: higher id first, then the lower shard
+	assert.Equal(t, []int{0, 1, 1, 0, 2, 0}, shards)
+}
+
+func TestUserRepository_ListUsers(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for i := 0; i < 7; i++ {
+		user := &models.User{
+			UserID: "list_user_" + string(rune('a'+i)),
+			Name:   "List User",
+			Email:  "list_" + string(rune('a'+i)) + "@example.com",
+		}
+		require.NoError(t, repo.Create(ctx, user))
+		defer repo.Delete(ctx, user.UserID)
+	}
+
+	// Wait for replication
+	time.Sleep(200 * time.Millisecond)
+
+	var listed []*models.User
+	cursor := ""
+	for {
+		page, err := repo.ListUsers(ctx, cursor, 3)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Users), 3)
+		listed = append(listed, page.Users...)
+
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	seen := make(map[string]bool)
+	for i, user := range listed {
+		assert.False(t, seen[user.UserID], "Users should not repeat across pages")
+		seen[user.UserID] = true
+
+		if i > 0 {
+			assert.False(t, user.CreatedAt.After(listed[i-1].CreatedAt), "Pages should be globally ordered")
+		}
+	}
+	for i := 0; i < 7; i++ {
+		assert.True(t, seen["list_user_"+string(rune('a'+i))])
+	}
+
+	_, err := repo.ListUsers(ctx, "", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// defaultScanBatchSize is how many rows each FETCH pulls from a server-side cursor
+const defaultScanBatchSize = 500
+
+// ScanOptions configures a full-cluster scan
+type ScanOptions struct {
+	// Ordered merges all shards into one stream ordered by created_at DESC, id DESC
+	// Unordered scans walk the shards one after another, which holds only one cursor open
+	Ordered bool
+
+	// BatchSize is the number of rows fetched per round trip; defaults to 500
+	BatchSize int
+}
+
+// ScanUsers streams every user in the cluster without materializing them
+// Rows are read from each shard's replica through a server-side cursor, in batches.
+// The scan stops on the first error, which is yielded as the last element.
+// Breaking out of the loop closes all cursors and releases their connections.
+//
+//	for user, err := range repo.ScanUsers(ctx, repository.ScanOptions{}) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+func (r *UserRepository) ScanUsers(ctx context.Context, opts ScanOptions) iter.Seq2[*models.User, error] {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultScanBatchSize
+	}
+
+	return func(yield func(*models.User, error) bool) {
+		shards := r.shardManager.GetAllShards()
+		if opts.Ordered {
+			scanOrdered(ctx, shards, opts, yield)
+			return
+		}
+		scanUnordered(ctx, shards, opts, yield)
+	}
+}
+
+// ForEachUser calls fn for every user in the cluster
+// It is the callback form of ScanUsers; returning an error from fn stops the scan
+func (r *UserRepository) ForEachUser(ctx context.Context, opts ScanOptions, fn func(*models.User) error) error {
+	for user, err := range r.ScanUsers(ctx, opts) {
+		if err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanUnordered(ctx context.Context, shards []*sharding.Shard, opts ScanOptions, yield func(*models.User, error) bool) {
+	for _, shard := range shards {
+		cur, err := openShardCursor(ctx, shard, opts)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		ok := func() bool {
+			defer cur.close(ctx)
+
+			for {
+				if err := cur.fill(ctx); err != nil {
+					yield(nil, err)
+					return false
+				}
+				if len(cur.users) == 0 {
+					return true
+				}
+
+				for _, user := range cur.users {
+					if !yield(user, nil) {
+						return false
+					}
+				}
+				cur.users = nil
+			}
+		}()
+		if !ok {
+			return
+		}
+	}
+}
+
+func scanOrdered(ctx context.Context, shards []*sharding.Shard, opts ScanOptions, yield func(*models.User, error) bool) {
+	cursors := make(map[int]*shardCursor, len(shards))
+	defer func() {
+		for _, cur := range cursors {
+			cur.close(ctx)
+		}
+	}()
+
+	// Every shard needs an open cursor to be merged
+	h := &userHeap{}
+	for _, shard := range shards {
+		cur, err := openShardCursor(ctx, shard, opts)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		cursors[shard.ShardID] = cur
+
+		if err := cur.fill(ctx); err != nil {
+			yield(nil, err)
+			return
+		}
+		if len(cur.users) > 0 {
+			heap.Push(h, &cur.shardStream)
+		}
+	}
+
+	for h.Len() > 0 {
+		s := (*h)[0]
+		user := s.users[0]
+		s.users = s.users[1:]
+
+		// Refill the stream from its cursor before it competes again
+		if len(s.users) == 0 {
+			if err := cursors[s.shardID].fill(ctx); err != nil {
+				yield(nil, err)
+				return
+			}
+		}
+		if len(s.users) == 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+
+		if !yield(user, nil) {
+			return
+		}
+	}
+}
+
+// shardCursor is a server-side cursor over one shard's users
+// The buffered rows live in the embedded shardStream so the cursor can be merged directly
+type shardCursor struct {
+	shardStream
+	tx        sharding.Tx
+	batchSize int
+	exhausted bool
+}
+
+func openShardCursor(ctx context.Context, shard *sharding.Shard, opts ScanOptions) (*shardCursor, error) {
+	// Cursors only live inside a transaction; a read-only repeatable-read
+	// transaction also gives the whole shard scan one consistent snapshot
+	tx, err := shard.ReplicaQuerier().Begin(ctx, sharding.TxOptions{
+		Isolation: sharding.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin scan on shard %d: %w", shard.ShardID, err)
+	}
+
+	query := `DECLARE users_scan NO SCROLL CURSOR FOR SELECT id, user_id, name, email, created_at, version FROM users`
+	if opts.Ordered {
+		query += ` ORDER BY created_at DESC, id DESC`
+	}
+
+	if _, err := tx.Exec(ctx, query); err != nil {
+		tx.Rollback(ctx)
+		return nil, fmt.Errorf("failed to declare cursor on shard %d: %w", shard.ShardID, err)
+	}
+
+	return &shardCursor{
+		shardStream: shardStream{shardID: shard.ShardID},
+		tx:          tx,
+		batchSize:   opts.BatchSize,
+	}, nil
+}
+
+// fill fetches the next batch if the buffer is empty
+// An empty buffer after fill means the shard has no more rows
+func (c *shardCursor) fill(ctx context.Context) error {
+	if len(c.users) > 0 || c.exhausted {
+		return nil
+	}
+
+	rows, err := c.tx.Query(ctx, fmt.Sprintf(`FETCH FORWARD %d FROM users_scan`, c.batchSize))
+	if err != nil {
+		return fmt.Errorf("failed to fetch from shard %d: %w", c.shardID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan user from shard %d: %w", c.shardID, err)
+		}
+		c.users = append(c.users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows from shard %d: %w", c.shardID, err)
+	}
+
+	if len(c.users) < c.batchSize {
+		c.exhausted = true
+	}
+
+	return nil
+}
+
+// close ends the cursor's transaction, which also closes the cursor
+func (c *shardCursor) close(ctx context.Context) {
+	c.tx.Rollback(context.WithoutCancel(ctx))
+}
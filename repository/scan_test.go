@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createScanUsers(t *testing.T, repo *UserRepository, n int) []string {
+	ctx := context.Background()
+
+	var userIDs []string
+	for i := 0; i < n; i++ {
+		user := &models.User{
+			UserID: "scan_user_" + string(rune('a'+i)),
+			Name:   "Scan User",
+			Email:  "scan_" + string(rune('a'+i)) + "@example.com",
+		}
+		require.NoError(t, repo.Create(ctx, user))
+		userIDs = append(userIDs, user.UserID)
+	}
+
+	// Wait for replication
+	time.Sleep(200 * time.Millisecond)
+	return userIDs
+}
+
+func TestUserRepository_ScanUsers(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	userIDs := createScanUsers(t, repo, 5)
+
+	for _, ordered := range []bool{false, true} {
+		seen := make(map[string]bool)
+		var previous *models.User
+
+		// A tiny batch size forces several FETCH round trips per shard
+		for user, err := range repo.ScanUsers(ctx, ScanOptions{Ordered: ordered, BatchSize: 2}) {
+			require.NoError(t, err)
+			assert.False(t, seen[user.UserID], "Users should be streamed once")
+			seen[user.UserID] = true
+
+			if ordered && previous != nil {
+				assert.False(t, user.CreatedAt.After(previous.CreatedAt), "Ordered scans should be globally ordered")
+			}
+			previous = user
+		}
+
+		for _, userID := range userIDs {
+			assert.True(t, seen[userID], "Scan should include %s", userID)
+		}
+	}
+}
+
+func TestUserRepository_ScanUsers_Break(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	createScanUsers(t, repo, 3)
+
+	for _, ordered := range []bool{false, true} {
+		count := 0
+		for _, err := range repo.ScanUsers(ctx, ScanOptions{Ordered: ordered, BatchSize: 1}) {
+			require.NoError(t, err)
+			count++
+			if count == 2 {
+				break
+			}
+		}
+		assert.Equal(t, 2, count)
+	}
+
+	// Breaking out must have released the connections and cursors
+	_, err := repo.CountUsersPerShard(ctx)
+	assert.NoError(t, err)
+}
+
+func TestUserRepository_ForEachUser(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	createScanUsers(t, repo, 2)
+
+	errStop := errors.New("stop")
+	visited := 0
+	err := repo.ForEachUser(ctx, ScanOptions{}, func(user *models.User) error {
+		visited++
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, visited)
+}
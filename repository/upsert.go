@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/samandartukhtayev/replication-and-sharding/sharding"
+)
+
+// UserPatch lists the columns Patch changes; nil fields are left as they are
+type UserPatch struct {
+	Name  *string
+	Email *string
+
+	// Version, if non-zero, makes Patch apply only if the user is still at that
+	// version, like Update; otherwise it fails with a *ConflictError
+	Version int64
+}
+
+// empty reports whether the patch changes no column
+func (p UserPatch) empty() bool {
+	return p.Name == nil && p.Email == nil
+}
+
+// set builds the SET list of the patch's columns, bumping the version, with
+// their arguments numbered from $1
+func (p UserPatch) set() (string, []any) {
+	var columns []string
+	var args []any
+	add := func(column string, value any) {
+		args = append(args, value)
+		columns = append(columns, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if p.Name != nil {
+		add("name", *p.Name)
+	}
+	if p.Email != nil {
+		add("email", *p.Email)
+	}
+
+	return strings.Join(append(columns, "version = version + 1"), ", "), args
+}
+
+// Upsert creates the user, or overwrites the name and email of the existing
+// user with the same user_id, and reports whether it inserted
+// Unlike Update it doesn't check user.Version: the last write wins. On success
+// user holds the stored row. Writes always go to the primary of the user's shard.
+// The email is reserved first, and a replaced email is released afterwards.
+// A user.created or user.updated event is published in the same transaction.
+func (r *UserRepository) Upsert(ctx context.Context, user *models.User) (bool, error) {
+	query := `
+		INSERT INTO users (id, user_id, name, email, created_at)
+		VALUES (users_next_id($4), $1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id) DO UPDATE
+		SET name = EXCLUDED.name, email = EXCLUDED.email, version = users.version + 1
+		RETURNING id, user_id, name, email, created_at, version, xmax = 0
+	`
+
+	acquired, err := r.emails.Reserve(ctx, normalizeEmail(user.Email), user.UserID)
+	if err != nil {
+		return false, fmt.Errorf("failed to upsert user: %w", err)
+	}
+
+	var oldEmail string
+	var inserted bool
+	stored := &models.User{}
+	err = r.shardManager.WithWriteTx(ctx, user.UserID, func(tx *sharding.ShardTx) error {
+		// Lock the current row, if any, to learn the email it gives up
+		oldEmail = ""
+		err := tx.QueryRow(ctx, `SELECT email FROM users WHERE user_id = $1 FOR UPDATE`, user.UserID).Scan(&oldEmail)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to upsert user: %w", err)
+		}
+
+		// xmax is 0 only for a freshly inserted row version
+		err = tx.QueryRow(ctx, query, user.UserID, user.Name, user.Email, tx.ShardID).
+			Scan(&stored.ID, &stored.UserID, &stored.Name, &stored.Email, &stored.CreatedAt, &stored.Version, &inserted)
+		if err != nil {
+			return fmt.Errorf("failed to upsert user: %w", err)
+		}
+
+		eventType := EventUserUpdated
+		if inserted {
+			eventType = EventUserCreated
+		}
+		return publishUserEvents(ctx, tx, userEvent(eventType, stored))
+	})
+	if err != nil {
+		if acquired {
+			r.releaseEmail(ctx, user.Email, user.UserID)
+		}
+		return false, err
+	}
+
+	*user = *stored
+	if oldEmail != "" && normalizeEmail(oldEmail) != normalizeEmail(user.Email) {
+		r.releaseEmail(ctx, oldEmail, user.UserID)
+	}
+
+	return inserted, nil
+}
+
+// Patch changes only the columns set in fields and returns the updated user
+// Writes always go to the primary of the user's shard. A new email is reserved
+// before the update and the old one released after it. A user.updated event is
+// published in the same transaction (see publishUserEvents).
+func (r *UserRepository) Patch(ctx context.Context, userID string, fields UserPatch) (*models.User, error) {
+	if fields.empty() {
+		return nil, fmt.Errorf("failed to patch user %s: no fields to update", userID)
+	}
+
+	set, args := fields.set()
+	query := fmt.Sprintf(`
+		UPDATE users
+		SET %s
+		WHERE user_id = $%d
+		RETURNING id, user_id, name, email, created_at, version
+	`, set, len(args)+1)
+	args = append(args, userID)
+
+	var acquired bool
+	if fields.Email != nil {
+		var err error
+		acquired, err = r.emails.Reserve(ctx, normalizeEmail(*fields.Email), userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to patch user: %w", err)
+		}
+	}
+
+	var oldEmail string
+	var updated *models.User
+	err := r.shardManager.WithWriteTx(ctx, userID, func(tx *sharding.ShardTx) error {
+		current, err := scanUser(tx.QueryRow(ctx, `
+			SELECT id, user_id, name, email, created_at, version
+			FROM users WHERE user_id = $1 FOR UPDATE
+		`, userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to patch user: %w", err)
+		}
+		if fields.Version != 0 && current.Version != fields.Version {
+			return &ConflictError{Current: current}
+		}
+		oldEmail = current.Email
+
+		updated, err = scanUser(tx.QueryRow(ctx, query, args...))
+		if err != nil {
+			return fmt.Errorf("failed to patch user: %w", err)
+		}
+
+		return publishUserEvents(ctx, tx, userEvent(EventUserUpdated, updated))
+	})
+	if err != nil {
+		if acquired {
+			r.releaseEmail(ctx, *fields.Email, userID)
+		}
+		return nil, err
+	}
+
+	if normalizeEmail(oldEmail) != normalizeEmail(updated.Email) {
+		r.releaseEmail(ctx, oldEmail, userID)
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samandartukhtayev/replication-and-sharding/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserPatch_Set(t *testing.T) {
+	name, email := "Ann", "ann@example.com"
+
+	assert.True(t, UserPatch{Version: 3}.empty())
+
+	set, args := UserPatch{Email: &email}.set()
+	assert.Equal(t, "email = $1, version = version + 1", set)
+	assert.Equal(t, []any{email}, args)
+
+	set, args = UserPatch{Name: &name, Email: &email}.set()
+	assert.Equal(t, "name = $1, email = $2, version = version + 1", set)
+	assert.Equal(t, []any{name, email}, args)
+}
+
+func TestUserRepository_Upsert(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "upsert_user", Name: "First", Email: "upsert_1@example.com"}
+	inserted, err := repo.Upsert(ctx, user)
+	require.NoError(t, err)
+	assert.True(t, inserted)
+	assert.NotZero(t, user.ID)
+	assert.Equal(t, int64(1), user.Version)
+
+	again := &models.User{UserID: "upsert_user", Name: "Second", Email: "upsert_2@example.com"}
+	inserted, err = repo.Upsert(ctx, again)
+	require.NoError(t, err)
+	assert.False(t, inserted)
+	assert.Equal(t, user.ID, again.ID)
+	assert.Equal(t, int64(2), again.Version)
+
+	current, err := repo.GetByUserIDFromPrimary(ctx, "upsert_user")
+	require.NoError(t, err)
+	assert.Equal(t, "Second", current.Name)
+
+	// The replaced email is free again
+	require.NoError(t, repo.Create(ctx, &models.User{UserID: "patch_user", Name: "Other", Email: "upsert_1@example.com"}))
+}
+
+func TestUserRepository_Patch(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "patch_user", Name: "Original", Email: "patch@example.com"}
+	require.NoError(t, repo.Create(ctx, user))
+
+	name := "Renamed"
+	patched, err := repo.Patch(ctx, user.UserID, UserPatch{Name: &name})
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", patched.Name)
+	assert.Equal(t, "patch@example.com", patched.Email)
+	assert.Equal(t, int64(2), patched.Version)
+
+	// A patch for an older version conflicts
+	_, err = repo.Patch(ctx, user.UserID, UserPatch{Name: &name, Version: 1})
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, int64(2), conflict.Current.Version)
+
+	_, err = repo.Patch(ctx, "missing_user", UserPatch{Name: &name})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	_, err = repo.Patch(ctx, user.UserID, UserPatch{})
+	assert.Error(t, err)
+}
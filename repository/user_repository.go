@@ -3,43 +3,133 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/samandartukhtayev/replication-and-sharding/models"
 	"github.com/samandartukhtayev/replication-and-sharding/sharding"
 )
 
+// defaultShardTimeout bounds each shard's part of a cross-shard query
+const defaultShardTimeout = 30 * time.Second
+
+// ErrUserNotFound is wrapped by the errors of lookups and writes whose user doesn't exist
+// It matches sharding.ErrNotFound too.
+var ErrUserNotFound = fmt.Errorf("user %w", sharding.ErrNotFound)
+
+// ErrConflict is wrapped by ConflictError; it is sharding.ErrConflict
+var ErrConflict = sharding.ErrConflict
+
+// ConflictError is returned by Update when the user was changed since it was read
+type ConflictError struct {
+	// Current is the user as it is now; retry with its Version after merging
+	Current *models.User
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: user %s is at version %d", ErrConflict, e.Current.UserID, e.Current.Version)
+}
+
+func (e *ConflictError) Unwrap() error { return ErrConflict }
+
 // UserRepository handles all user-related database operations
 // It abstracts away the sharding and replication complexity from the application layer
 type UserRepository struct {
 	shardManager *sharding.ShardManager
+	fanOut       sharding.FanOutOptions
+	emails       *sharding.UniqueIndex
 }
 
 // NewUserRepository creates a new user repository
 func NewUserRepository(sm *sharding.ShardManager) *UserRepository {
 	return &UserRepository{
 		shardManager: sm,
+		fanOut: sharding.FanOutOptions{
+			Policy:       sharding.FailFast,
+			ShardTimeout: defaultShardTimeout,
+		},
+		emails: sharding.NewUniqueIndex(sm, emailScope),
 	}
 }
 
 // Create creates a new user
 // Writes always go to the primary database of the appropriate shard
+// and are fenced against the shard's routing epoch.
+// The generated ID is globally unique and encodes the shard it was created on.
+// The email is reserved cluster-wide first; an email in use by another user fails the create.
+// A user.created event is published in the same transaction (see publishUserEvents).
 func (r *UserRepository) Create(ctx context.Context, user *models.User) error {
-	// Determine which shard to write to based on the shard key (user_id)
-	db := r.shardManager.GetPrimaryDB(user.UserID)
+	return r.CreateIdempotent(ctx, "", user)
+}
 
+// CreateIdempotent is Create guarded by an idempotency key
+// The key is stored on the user's shard in the create's transaction, with the
+// created user. Calling it again with the same key and user creates nothing and
+// fills user from that result, so a client can retry a create whose outcome it
+// doesn't know, even after the user changed. Keys are scoped to the user; reusing
+// one for another request fails with ErrIdempotencyKeyReused. An empty key makes it Create.
+func (r *UserRepository) CreateIdempotent(ctx context.Context, key string, user *models.User) error {
 	query := `
-		INSERT INTO users (user_id, name, email, created_at)
-		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
-		RETURNING id, created_at
+		INSERT INTO users (id, user_id, name, email, created_at)
+		VALUES (users_next_id($4), $1, $2, $3, CURRENT_TIMESTAMP)
+		RETURNING id, created_at, version
 	`
 
-	err := db.QueryRowContext(ctx, query, user.UserID, user.Name, user.Email).
-		Scan(&user.ID, &user.CreatedAt)
+	// A replay must not reserve the email again: it may have changed hands since
+	if key != "" {
+		replayed, err := r.findReplay(ctx, key, opCreate, user)
+		if err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+		if replayed != nil {
+			*user = *replayed
+			return nil
+		}
+	}
+
+	acquired, err := r.emails.Reserve(ctx, normalizeEmail(user.Email), user.UserID)
 	if err != nil {
 		return fmt.Errorf("failed to create user: %w", err)
 	}
 
+	// Determine which shard to write to based on the shard key (user_id)
+	// With a key, a retried commit replays instead of creating twice
+	var replayed *models.User
+	err = r.shardManager.WithShardTx(ctx, user.UserID, sharding.TxOptions{Idempotent: key != ""}, func(tx *sharding.ShardTx) error {
+		if key != "" {
+			var err error
+			if replayed, err = claimIdempotencyKey(ctx, tx, key, opCreate, user); err != nil || replayed != nil {
+				return err
+			}
+		}
+
+		err := tx.QueryRow(ctx, query, user.UserID, user.Name, user.Email, tx.ShardID).
+			Scan(&user.ID, &user.CreatedAt, &user.Version)
+		if err != nil {
+			return err
+		}
+
+		if err := publishUserEvents(ctx, tx, userEvent(EventUserCreated, user)); err != nil {
+			return err
+		}
+		if key != "" {
+			return saveIdempotentResult(ctx, tx, key, user)
+		}
+		return nil
+	})
+	if err != nil {
+		if acquired {
+			r.releaseEmail(ctx, user.Email, user.UserID)
+		}
+		return fmt.Errorf("failed to create user: %w", err)
+	}
+
+	// A concurrent first use of the key won the claim; an email reserved here
+	// may be the one it relies on, so a stray reservation is left to the cleanup job
+	if replayed != nil {
+		*user = *replayed
+	}
 	return nil
 }
 
@@ -47,20 +137,57 @@ func (r *UserRepository) Create(ctx context.Context, user *models.User) error {
 // Reads can come from replica databases for better load distribution
 func (r *UserRepository) GetByUserID(ctx context.Context, userID string) (*models.User, error) {
 	// Read from replica to reduce load on primary
-	db := r.shardManager.GetReplicaDB(userID)
-
 	query := `
-		SELECT id, user_id, name, email, created_at
+		SELECT id, user_id, name, email, created_at, version
 		FROM users
 		WHERE user_id = $1
 	`
 
-	user := &models.User{}
-	err := db.QueryRowContext(ctx, query, userID).
-		Scan(&user.ID, &user.UserID, &user.Name, &user.Email, &user.CreatedAt)
+	var user *models.User
+	err := r.shardManager.ReadReplica(ctx, userID, func(db sharding.Querier) error {
+		var err error
+		user, err = scanUser(db.QueryRow(ctx, query, userID))
+		return err
+	})
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found: %s", userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return user, nil
+}
+
+// GetByID retrieves a user by their globally unique ID
+// The ID encodes the shard that created it, so this is a single-shard replica read.
+// IDs assigned before the switch to Snowflake-style IDs (below sharding.MinID)
+// do not encode a shard and are not found, even if shard 0 has such a row.
+func (r *UserRepository) GetByID(ctx context.Context, id int64) (*models.User, error) {
+	if id < sharding.MinID {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+
+	shard, err := r.shardManager.GetShardByID(sharding.ShardFromID(id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+
+	query := `
+		SELECT id, user_id, name, email, created_at, version
+		FROM users
+		WHERE id = $1
+	`
+
+	var user *models.User
+	err = r.shardManager.ReadShardReplica(ctx, shard, func(db sharding.Querier) error {
+		var err error
+		user, err = scanUser(db.QueryRow(ctx, query, id))
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %d", ErrUserNotFound, id)
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -72,20 +199,21 @@ func (r *UserRepository) GetByUserID(ctx context.Context, userID string) (*model
 // Use this when you need the most up-to-date data (e.g., after a write)
 func (r *UserRepository) GetByUserIDFromPrimary(ctx context.Context, userID string) (*models.User, error) {
 	// Read from primary for strong consistency
-	db := r.shardManager.GetPrimaryDB(userID)
-
 	query := `
-		SELECT id, user_id, name, email, created_at
+		SELECT id, user_id, name, email, created_at, version
 		FROM users
 		WHERE user_id = $1
 	`
 
-	user := &models.User{}
-	err := db.QueryRowContext(ctx, query, userID).
-		Scan(&user.ID, &user.UserID, &user.Name, &user.Email, &user.CreatedAt)
+	var user *models.User
+	err := r.shardManager.ReadPrimary(ctx, userID, func(db sharding.Querier) error {
+		var err error
+		user, err = scanUser(db.QueryRow(ctx, query, userID))
+		return err
+	})
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found: %s", userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrUserNotFound, userID)
 		}
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
@@ -93,55 +221,129 @@ func (r *UserRepository) GetByUserIDFromPrimary(ctx context.Context, userID stri
 	return user, nil
 }
 
-// Update updates an existing user
-// Writes always go to the primary database
+// Update updates an existing user if it is still at user.Version
+// If another write got there first, it returns a *ConflictError carrying the
+// current row and changes nothing. On success user holds the new version.
+// Writes always go to the primary database.
+// A new email is reserved before the update and the old one released after it.
+// A user.updated event is published in the same transaction (see publishUserEvents).
 func (r *UserRepository) Update(ctx context.Context, user *models.User) error {
-	db := r.shardManager.GetPrimaryDB(user.UserID)
+	return r.UpdateIdempotent(ctx, "", user)
+}
 
+// UpdateIdempotent is Update guarded by an idempotency key
+// Like CreateIdempotent, calling it again with the same key and user changes
+// nothing and fills user from the first call's result, instead of failing
+// with a *ConflictError because the first call already bumped the version.
+// An empty key makes it Update.
+func (r *UserRepository) UpdateIdempotent(ctx context.Context, key string, user *models.User) error {
 	query := `
 		UPDATE users
-		SET name = $1, email = $2
-		WHERE user_id = $3
+		SET name = $1, email = $2, version = version + 1
+		WHERE user_id = $3 AND version = $4
+		RETURNING id, user_id, name, email, created_at, version
 	`
 
-	result, err := db.ExecContext(ctx, query, user.Name, user.Email, user.UserID)
+	// A replay must not reserve the email again: it may have changed hands since
+	if key != "" {
+		replayed, err := r.findReplay(ctx, key, opUpdate, user)
+		if err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+		if replayed != nil {
+			*user = *replayed
+			return nil
+		}
+	}
+
+	acquired, err := r.emails.Reserve(ctx, normalizeEmail(user.Email), user.UserID)
 	if err != nil {
 		return fmt.Errorf("failed to update user: %w", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	var oldEmail string
+	var updated *models.User
+	err = r.shardManager.WithShardTx(ctx, user.UserID, sharding.TxOptions{Idempotent: key != ""}, func(tx *sharding.ShardTx) error {
+		if key != "" {
+			replayed, err := claimIdempotencyKey(ctx, tx, key, opUpdate, user)
+			if err != nil {
+				return err
+			}
+			if replayed != nil {
+				// A concurrent first use of the key won the claim and does the
+				// email bookkeeping; a stray reservation is left to the cleanup job
+				updated, oldEmail = replayed, replayed.Email
+				return nil
+			}
+		}
+
+		current, err := scanUser(tx.QueryRow(ctx, `
+			SELECT id, user_id, name, email, created_at, version
+			FROM users WHERE user_id = $1 FOR UPDATE
+		`, user.UserID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, user.UserID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+		if current.Version != user.Version {
+			return &ConflictError{Current: current}
+		}
+		oldEmail = current.Email
+
+		updated, err = scanUser(tx.QueryRow(ctx, query, user.Name, user.Email, user.UserID, user.Version))
+		if err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+
+		if err := publishUserEvents(ctx, tx, userEvent(EventUserUpdated, updated)); err != nil {
+			return err
+		}
+		if key != "" {
+			return saveIdempotentResult(ctx, tx, key, updated)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
+		if acquired {
+			r.releaseEmail(ctx, user.Email, user.UserID)
+		}
+		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("user not found: %s", user.UserID)
+	*user = *updated
+	if normalizeEmail(oldEmail) != normalizeEmail(user.Email) {
+		r.releaseEmail(ctx, oldEmail, user.UserID)
 	}
 
 	return nil
 }
 
 // Delete deletes a user by their user_id
-// Writes always go to the primary database
+// Writes always go to the primary database; the user's email reservation is released afterwards.
+// A user.deleted event is published in the same transaction (see publishUserEvents).
 func (r *UserRepository) Delete(ctx context.Context, userID string) error {
-	db := r.shardManager.GetPrimaryDB(userID)
-
-	query := `DELETE FROM users WHERE user_id = $1`
-
-	result, err := db.ExecContext(ctx, query, userID)
-	if err != nil {
-		return fmt.Errorf("failed to delete user: %w", err)
-	}
+	query := `DELETE FROM users WHERE user_id = $1 RETURNING id, user_id, name, email, created_at, version`
+
+	var deleted *models.User
+	err := r.shardManager.WithWriteTx(ctx, userID, func(tx *sharding.ShardTx) error {
+		var err error
+		deleted, err = scanUser(tx.QueryRow(ctx, query, userID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, userID)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
 
-	rowsAffected, err := result.RowsAffected()
+		return publishUserEvents(ctx, tx, userEvent(EventUserDeleted, deleted))
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
-
-	if rowsAffected == 0 {
-		return fmt.Errorf("user not found: %s", userID)
+		return err
 	}
 
+	r.releaseEmail(ctx, deleted.Email, userID)
 	return nil
 }
 
@@ -149,41 +351,35 @@ func (r *UserRepository) Delete(ctx context.Context, userID string) error {
 // This is an expensive operation as it queries all shards
 // Use pagination in production scenarios
 func (r *UserRepository) GetAllUsers(ctx context.Context) ([]*models.User, error) {
-	shards := r.shardManager.GetAllShards()
-	var allUsers []*models.User
-
 	query := `
-		SELECT id, user_id, name, email, created_at
+		SELECT id, user_id, name, email, created_at, version
 		FROM users
 		ORDER BY created_at DESC
 	`
 
-	// Query each shard
-	for _, shard := range shards {
-		// Use replica for reads
-		db := shard.Replicas[0]
-		if db == nil {
-			db = shard.Primary
-		}
-
-		rows, err := db.QueryContext(ctx, query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to query shard %d: %w", shard.ShardID, err)
-		}
-
-		for rows.Next() {
-			user := &models.User{}
-			if err := rows.Scan(&user.ID, &user.UserID, &user.Name, &user.Email, &user.CreatedAt); err != nil {
-				rows.Close()
-				return nil, fmt.Errorf("failed to scan user from shard %d: %w", shard.ShardID, err)
+	// Query every shard concurrently, failing on the first shard error
+	result, err := sharding.FanOut(ctx, r.shardManager.GetAllShards(), r.fanOut,
+		func(ctx context.Context, shard *sharding.Shard) ([]*models.User, error) {
+			// Use replicas for reads
+			var users []*models.User
+			err := r.shardManager.ReadShardReplica(ctx, shard, func(db sharding.Querier) error {
+				var err error
+				users, err = queryUsers(ctx, db, query)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to query users: %w", err)
 			}
-			allUsers = append(allUsers, user)
-		}
 
-		rows.Close()
-		if err := rows.Err(); err != nil {
-			return nil, fmt.Errorf("error iterating rows from shard %d: %w", shard.ShardID, err)
-		}
+			return users, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var allUsers []*models.User
+	for _, res := range result.Results {
+		allUsers = append(allUsers, res.Value...)
 	}
 
 	return allUsers, nil
@@ -192,19 +388,60 @@ func (r *UserRepository) GetAllUsers(ctx context.Context) ([]*models.User, error
 // CountUsersPerShard returns the count of users in each shard
 // Useful for monitoring shard distribution
 func (r *UserRepository) CountUsersPerShard(ctx context.Context) (map[int]int, error) {
-	shards := r.shardManager.GetAllShards()
+	query := `SELECT COUNT(*) FROM users`
+
+	result, err := sharding.FanOut(ctx, r.shardManager.GetAllShards(), r.fanOut,
+		func(ctx context.Context, shard *sharding.Shard) (int, error) {
+			var count int
+			err := r.shardManager.ReadShardPrimary(ctx, shard, func(db sharding.Querier) error {
+				return db.QueryRow(ctx, query).Scan(&count)
+			})
+			if err != nil {
+				return 0, fmt.Errorf("failed to count users: %w", err)
+			}
+			return count, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
 	counts := make(map[int]int)
+	for _, res := range result.Results {
+		counts[res.ShardID] = res.Value
+	}
 
-	query := `SELECT COUNT(*) FROM users`
+	return counts, nil
+}
 
-	for _, shard := range shards {
-		var count int
-		err := shard.Primary.QueryRowContext(ctx, query).Scan(&count)
+// queryUsers runs a query selecting users' columns in scanUser's order
+func queryUsers(ctx context.Context, db sharding.Querier, query string, args ...any) ([]*models.User, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
 		if err != nil {
-			return nil, fmt.Errorf("failed to count users in shard %d: %w", shard.ShardID, err)
+			return nil, fmt.Errorf("failed to scan user: %w", err)
 		}
-		counts[shard.ShardID] = count
+		users = append(users, user)
 	}
 
-	return counts, nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return users, nil
+}
+
+// scanUser scans a row selected as: id, user_id, name, email, created_at, version
+func scanUser(row sharding.Row) (*models.User, error) {
+	user := &models.User{}
+	if err := row.Scan(&user.ID, &user.UserID, &user.Name, &user.Email, &user.CreatedAt, &user.Version); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
@@ -51,6 +51,10 @@ func cleanupAllTestData(t *testing.T, repo *UserRepository) {
 		"count_user_1", "count_user_2", "count_user_3",
 		"replication_test_user",
 		"all_users_1", "all_users_2", "all_users_3",
+		"scan_user_a", "scan_user_b", "scan_user_c", "scan_user_d", "scan_user_e",
+		"batch_dup_0", "get_by_id_user",
+		"email_user_1", "email_user_2", "email_user_3", "email_user_4", "email_user_5",
+		"email_user_6", "email_user_7", "conflict_user", "idem_user", "idem_user_2", "upsert_user", "patch_user",
 	}
 
 	for _, userID := range testUserIDs {
@@ -158,6 +162,67 @@ func TestUserRepository_Update(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestUserRepository_UpdateConflict(t *testing.T) {
+	repo, _, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "conflict_user", Name: "Original", Email: "conflict@example.com"}
+	require.NoError(t, repo.Create(ctx, user))
+	assert.Equal(t, int64(1), user.Version)
+
+	// Two editors start from the same version
+	stale := *user
+
+	user.Name = "First Edit"
+	require.NoError(t, repo.Update(ctx, user))
+	assert.Equal(t, int64(2), user.Version)
+
+	stale.Name = "Second Edit"
+	err := repo.Update(ctx, &stale)
+	require.ErrorIs(t, err, ErrConflict)
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "First Edit", conflict.Current.Name)
+	assert.Equal(t, int64(2), conflict.Current.Version)
+
+	// Retrying from the current row succeeds
+	stale = *conflict.Current
+	stale.Name = "Second Edit"
+	require.NoError(t, repo.Update(ctx, &stale))
+	assert.Equal(t, int64(3), stale.Version)
+
+	current, err := repo.GetByUserIDFromPrimary(ctx, user.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, "Second Edit", current.Name)
+}
+
+func TestUserRepository_ErrorCategories(t *testing.T) {
+	repo, sm, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{UserID: "test_user_1", Name: "Dup", Email: "dup_1@example.com"}
+	require.NoError(t, repo.Create(ctx, user))
+
+	// Same user_id: the primary reports a unique violation
+	err := repo.Create(ctx, &models.User{UserID: "test_user_1", Name: "Dup", Email: "dup_2@example.com"})
+	assert.ErrorIs(t, err, sharding.ErrAlreadyExists)
+	assert.False(t, sharding.IsRetryable(err))
+
+	var shardErr *sharding.ShardError
+	require.ErrorAs(t, err, &shardErr)
+	assert.Equal(t, sm.GetShardID(user.UserID), shardErr.ShardID)
+	assert.Equal(t, sharding.RolePrimary, shardErr.Role)
+	assert.Equal(t, "23505", shardErr.Code)
+
+	_, err = repo.GetByUserID(ctx, "missing_user")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.ErrorIs(t, err, sharding.ErrNotFound)
+}
+
 func TestUserRepository_Delete(t *testing.T) {
 	repo, _, cleanup := setupTestRepository(t)
 	defer cleanup()
@@ -323,6 +388,44 @@ func TestUserRepository_Replication(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestUserRepository_GetByID(t *testing.T) {
+	repo, sm, cleanup := setupTestRepository(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	user := &models.User{
+		UserID: "get_by_id_user",
+		Name:   "Get By ID",
+		Email:  "getbyid@example.com",
+	}
+	require.NoError(t, repo.Create(ctx, user))
+	defer repo.Delete(ctx, user.UserID)
+
+	// The ID should encode the shard the user was routed to
+	assert.Equal(t, sm.GetShardID(user.UserID), sharding.ShardFromID(user.ID))
+
+	time.Sleep(200 * time.Millisecond)
+
+	found, err := repo.GetByID(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, user.UserID, found.UserID)
+	assert.Equal(t, user.ID, found.ID)
+
+	_, err = repo.GetByID(ctx, user.ID+1)
+	assert.Error(t, err)
+}
+
+func TestUserRepository_GetByLegacyID(t *testing.T) {
+	// Legacy serial IDs are refused before routing, so no shard is needed
+	repo := &UserRepository{}
+
+	_, err := repo.GetByID(context.Background(), 42)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = repo.GetByID(context.Background(), sharding.MinID-1)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
 func TestUserRepository_GetAllUsers(t *testing.T) {
 	repo, _, cleanup := setupTestRepository(t)
 	defer cleanup()
@@ -369,3 +472,38 @@ func TestUserRepository_GetAllUsers(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestUserRepository_PgxPoolBackend(t *testing.T) {
+	sm, err := sharding.NewShardManagerWithOptions(config.DefaultConfig(), sharding.Options{Backend: sharding.BackendPgxPool})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	repo := NewUserRepository(sm)
+	ctx := context.Background()
+
+	user := &models.User{
+		UserID: "pgx_backend_user",
+		Name:   "Pgx Backend",
+		Email:  "pgx@example.com",
+	}
+	_ = repo.Delete(ctx, user.UserID)
+
+	// The repository works unchanged on the native pgxpool backend
+	err = repo.Create(ctx, user)
+	require.NoError(t, err)
+	assert.NotZero(t, user.ID)
+
+	retrieved, err := repo.GetByUserIDFromPrimary(ctx, user.UserID)
+	require.NoError(t, err)
+	assert.Equal(t, user.Email, retrieved.Email)
+
+	counts, err := repo.CountUsersPerShard(ctx)
+	require.NoError(t, err)
+	assert.Len(t, counts, sm.NumShards())
+
+	err = repo.Delete(ctx, user.UserID)
+	require.NoError(t, err)
+
+	_, err = repo.GetByUserIDFromPrimary(ctx, user.UserID)
+	assert.Error(t, err, "User should not be found after deletion")
+}
@@ -0,0 +1,246 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+)
+
+// CatalogChannel is the NOTIFY channel the catalog publishes topology versions on
+const CatalogChannel = "topology_changed"
+
+// catalogWatcher follows the catalog database and applies new topology versions
+type catalogWatcher struct {
+	db     *sql.DB
+	dsn    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewShardManagerFromCatalog creates a shard manager whose topology is owned by the catalog database
+// The manager subscribes to catalog changes, so every instance converges on the same routing version
+func NewShardManagerFromCatalog(ctx context.Context, catalogCfg config.DatabaseConfig, opts Options) (*ShardManager, error) {
+	catalogDB, err := sql.Open("pgx", catalogCfg.ConnectionString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to catalog: %w", err)
+	}
+
+	cfg, err := LoadCatalogConfig(ctx, catalogDB)
+	if err != nil {
+		catalogDB.Close()
+		return nil, err
+	}
+
+	sm, err := NewShardManagerWithOptions(cfg, opts)
+	if err != nil {
+		catalogDB.Close()
+		return nil, err
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	sm.catalog = &catalogWatcher{
+		db:     catalogDB,
+		dsn:    catalogCfg.ConnectionString(),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go sm.watchCatalog(watchCtx)
+
+	return sm, nil
+}
+
+// LoadCatalogConfig reads shards, nodes and bucket assignments from the catalog
+// Everything is read in one repeatable-read snapshot so the version matches the rows
+func LoadCatalogConfig(ctx context.Context, db *sql.DB) (*config.Config, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open catalog snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	cfg := &config.Config{}
+
+	if err := tx.QueryRowContext(ctx, `SELECT version FROM topology_version`).Scan(&cfg.Version); err != nil {
+		return nil, fmt.Errorf("failed to read topology version: %w", err)
+	}
+
+	// Shards
+	rows, err := tx.QueryContext(ctx, `SELECT shard_id FROM shards ORDER BY shard_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shards: %w", err)
+	}
+	index := make(map[int]int)
+	for rows.Next() {
+		var shardID int
+		if err := rows.Scan(&shardID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan shard: %w", err)
+		}
+		index[shardID] = len(cfg.Shards)
+		cfg.Shards = append(cfg.Shards, config.ShardConfig{ShardID: shardID})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating shards: %w", err)
+	}
+
+	// Nodes
+	rows, err = tx.QueryContext(ctx, `
+		SELECT shard_id, role, host, port, username, password, dbname
+		FROM nodes
+		ORDER BY shard_id, node_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nodes: %w", err)
+	}
+	hasPrimary := make(map[int]bool)
+	for rows.Next() {
+		var shardID int
+		var role string
+		var node config.DatabaseConfig
+		if err := rows.Scan(&shardID, &role, &node.Host, &node.Port, &node.User, &node.Password, &node.DBName); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan node: %w", err)
+		}
+
+		i, ok := index[shardID]
+		if !ok {
+			rows.Close()
+			return nil, fmt.Errorf("node references unknown shard %d", shardID)
+		}
+
+		switch role {
+		case "primary":
+			if hasPrimary[shardID] {
+				rows.Close()
+				return nil, fmt.Errorf("shard %d has more than one primary", shardID)
+			}
+			hasPrimary[shardID] = true
+			cfg.Shards[i].Primary = node
+		case "replica":
+			cfg.Shards[i].Replicas = append(cfg.Shards[i].Replicas, node)
+		default:
+			rows.Close()
+			return nil, fmt.Errorf("unknown role %q for node of shard %d", role, shardID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating nodes: %w", err)
+	}
+
+	for _, shardCfg := range cfg.Shards {
+		if !hasPrimary[shardCfg.ShardID] {
+			return nil, fmt.Errorf("shard %d has no primary", shardCfg.ShardID)
+		}
+	}
+
+	// Bucket assignments
+	rows, err = tx.QueryContext(ctx, `SELECT bucket, shard_id FROM buckets ORDER BY bucket`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buckets: %w", err)
+	}
+	for rows.Next() {
+		var bucket, shardID int
+		if err := rows.Scan(&bucket, &shardID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan bucket: %w", err)
+		}
+		if bucket != len(cfg.Buckets) {
+			rows.Close()
+			return nil, fmt.Errorf("bucket numbering has a gap at %d", len(cfg.Buckets))
+		}
+		cfg.Buckets = append(cfg.Buckets, shardID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating buckets: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Refresh reloads the topology from the catalog and applies it if its version is newer
+// Managers created from a static configuration have nothing to refresh
+func (sm *ShardManager) Refresh(ctx context.Context) error {
+	if sm.catalog == nil {
+		return nil
+	}
+
+	cfg, err := LoadCatalogConfig(ctx, sm.catalog.db)
+	if err != nil {
+		return err
+	}
+
+	if err := sm.applyConfig(cfg); err != nil {
+		return fmt.Errorf("failed to apply topology version %d: %w", cfg.Version, err)
+	}
+
+	return nil
+}
+
+// watchCatalog listens for topology notifications until the context is cancelled
+// After every (re)connect the catalog is reloaded, so notifications missed while
+// disconnected can't leave the manager on an old version
+func (sm *ShardManager) watchCatalog(ctx context.Context) {
+	defer close(sm.catalog.done)
+
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := sm.listenCatalog(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("catalog watcher: %v (retrying in %s)", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// listenCatalog holds a single LISTEN session and returns when it fails
+func (sm *ShardManager) listenCatalog(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, sm.catalog.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+CatalogChannel); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	if err := sm.Refresh(ctx); err != nil {
+		return fmt.Errorf("failed to refresh: %w", err)
+	}
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+
+		if err := sm.Refresh(ctx); err != nil {
+			return fmt.Errorf("failed to refresh: %w", err)
+		}
+	}
+}
+
+// stop cancels the watcher, waits for it to exit and closes the catalog connection
+func (cw *catalogWatcher) stop() {
+	cw.cancel()
+	<-cw.done
+	cw.db.Close()
+}
@@ -0,0 +1,70 @@
+package sharding
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routingOnlyManager builds a manager that can route keys but has no connections
+func routingOnlyManager(numShards int, buckets []int) *ShardManager {
+	sm := &ShardManager{}
+	sm.routing.Store(&routingTable{shards: make([]*Shard, numShards), buckets: buckets})
+	return sm
+}
+
+func TestShardManager_BucketRouting(t *testing.T) {
+	modulo := routingOnlyManager(3, nil)
+	bucketed := routingOnlyManager(3, []int{0, 1, 2, 0, 1, 2, 0, 1, 2, 0, 1, 2})
+
+	// 12 round-robin buckets over 3 shards must route exactly like modulo
+	for i := 0; i < 1000; i++ {
+		key := "user_" + string(rune(i))
+		assert.Equal(t, modulo.GetShardID(key), bucketed.GetShardID(key))
+	}
+
+	// Reassigning every bucket to shard 2 moves every key there
+	moved := routingOnlyManager(3, []int{2, 2, 2})
+	assert.Equal(t, 2, moved.GetShardID("user_1"))
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := config.DefaultConfig()
+	assert.NoError(t, validateConfig(valid))
+
+	empty := &config.Config{}
+	assert.Error(t, validateConfig(empty))
+
+	gap := &config.Config{Shards: []config.ShardConfig{{ShardID: 0}, {ShardID: 2}}}
+	assert.Error(t, validateConfig(gap))
+
+	duplicate := &config.Config{Shards: []config.ShardConfig{{ShardID: 0}, {ShardID: 0}}}
+	assert.Error(t, validateConfig(duplicate))
+
+	badBucket := &config.Config{Shards: []config.ShardConfig{{ShardID: 0}}, Buckets: []int{0, 1}}
+	assert.Error(t, validateConfig(badBucket))
+}
+
+func TestShardManager_FromCatalog(t *testing.T) {
+	ctx := context.Background()
+	sm, err := NewShardManagerFromCatalog(ctx, config.DefaultCatalogConfig(), Options{})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	assert.Greater(t, sm.Version(), int64(0), "Catalog topology should be versioned")
+	assert.Equal(t, 3, sm.NumShards())
+
+	// The seeded catalog routes like the static default configuration
+	static := routingOnlyManager(len(config.DefaultConfig().Shards), nil)
+	for _, key := range []string{"user_1", "user_2", "user_100"} {
+		assert.Equal(t, static.GetShardID(key), sm.GetShardID(key))
+	}
+
+	// Refreshing an unchanged catalog keeps the version
+	version := sm.Version()
+	require.NoError(t, sm.Refresh(ctx))
+	assert.Equal(t, version, sm.Version())
+}
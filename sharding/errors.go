@@ -0,0 +1,254 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Error categories; match them with errors.Is
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrAlreadyExists    = errors.New("already exists")
+	ErrConflict         = errors.New("conflict")
+	ErrShardUnavailable = errors.New("shard unavailable")
+	ErrReadOnly         = errors.New("read-only")
+)
+
+// Postgres error codes the categories are derived from
+const (
+	pgUniqueViolation         = "23505"
+	pgReadOnlySQLTransaction  = "25006"
+	pgTooManyConnections      = "53300"
+	pgAdminShutdown           = "57P01"
+	pgCrashShutdown           = "57P02"
+	pgCannotConnectNow        = "57P03"
+	pgConnectionExceptionCode = "08" // class prefix
+)
+
+// ShardError is an error returned by a node of a shard
+// It matches its category (ErrNotFound, ErrConflict, ...) and the underlying
+// error, such as a *pgconn.PgError, with errors.Is and errors.As.
+type ShardError struct {
+	ShardID int
+	Role    NodeRole
+
+	// Code is the Postgres SQLSTATE, if the server reported one
+	Code string
+	Err  error
+
+	kind      error
+	retryable bool
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %d (%s): %v", e.ShardID, e.Role, e.Err)
+}
+
+func (e *ShardError) Unwrap() []error {
+	if e.kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.kind, e.Err}
+}
+
+// Retryable reports whether the same operation may succeed if tried again:
+// serialization failures, deadlocks and unreachable or restarting nodes
+func (e *ShardError) Retryable() bool {
+	return e.retryable
+}
+
+// WrapError classifies an error returned by a node of the given shard and role
+// Errors that already carry a *ShardError are returned unchanged.
+func WrapError(err error, shardID int, role NodeRole) error {
+	if err == nil {
+		return nil
+	}
+	var shardErr *ShardError
+	if errors.As(err, &shardErr) {
+		return err
+	}
+
+	e := &ShardError{ShardID: shardID, Role: role, Err: err}
+	e.kind, e.Code, e.retryable = classify(err)
+	return e
+}
+
+// IsRetryable reports whether an operation that failed with err may succeed if
+// tried again; every other error is permanent. Context errors are permanent:
+// the caller gave up.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var stale *StaleEpochError
+	if errors.As(err, &stale) {
+		return true
+	}
+
+	var shardErr *ShardError
+	if errors.As(err, &shardErr) {
+		return shardErr.retryable
+	}
+
+	_, _, retryable := classify(err)
+	return retryable
+}
+
+// classify maps an error to its category, SQLSTATE and retryability
+func classify(err error) (kind error, code string, retryable bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		code = pgErr.Code
+		switch {
+		case code == pgUniqueViolation:
+			return ErrAlreadyExists, code, false
+		case code == pgSerializationFailure || code == pgDeadlockDetected:
+			return ErrConflict, code, true
+		case code == pgReadOnlySQLTransaction:
+			return ErrReadOnly, code, false
+		case code == pgTooManyConnections, code == pgAdminShutdown, code == pgCrashShutdown,
+			code == pgCannotConnectNow, strings.HasPrefix(code, pgConnectionExceptionCode):
+			return ErrShardUnavailable, code, true
+		}
+		return nil, code, false
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return nil, "", false
+	case errors.Is(err, sql.ErrNoRows), errors.Is(err, pgx.ErrNoRows):
+		return ErrNotFound, "", false
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	if errors.As(err, &connectErr) || errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) {
+		return ErrShardUnavailable, "", true
+	}
+
+	return nil, "", false
+}
+
+// nodeQuerier wraps the errors of a node's Querier, and of the transactions
+// and rows it returns, with the node's shard and role
+type nodeQuerier struct {
+	q       Querier
+	shardID int
+	role    NodeRole
+}
+
+// batchNodeQuerier is a nodeQuerier over a Querier that implements Batcher
+type batchNodeQuerier struct {
+	nodeQuerier
+	b Batcher
+}
+
+func (q batchNodeQuerier) SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults {
+	return q.b.SendBatch(ctx, batch)
+}
+
+// newNodeQuerier wraps q, keeping its Batcher implementation if it has one
+func newNodeQuerier(q Querier, shardID int, role NodeRole) Querier {
+	nq := nodeQuerier{q: q, shardID: shardID, role: role}
+	if b, ok := q.(Batcher); ok {
+		return batchNodeQuerier{nodeQuerier: nq, b: b}
+	}
+	return nq
+}
+
+func (q nodeQuerier) wrap(err error) error {
+	return WrapError(err, q.shardID, q.role)
+}
+
+func (q nodeQuerier) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	n, err := q.q.Exec(ctx, query, args...)
+	return n, q.wrap(err)
+}
+
+func (q nodeQuerier) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := q.q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, q.wrap(err)
+	}
+	return nodeRows{rows, q}, nil
+}
+
+func (q nodeQuerier) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return nodeRow{q.q.QueryRow(ctx, query, args...), q}
+}
+
+func (q nodeQuerier) Begin(ctx context.Context, opts TxOptions) (Tx, error) {
+	tx, err := q.q.Begin(ctx, opts)
+	if err != nil {
+		return nil, q.wrap(err)
+	}
+	return nodeTx{tx, q}, nil
+}
+
+func (q nodeQuerier) Ping(ctx context.Context) error {
+	return q.wrap(q.q.Ping(ctx))
+}
+
+type nodeTx struct {
+	tx Tx
+	q  nodeQuerier
+}
+
+func (t nodeTx) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	n, err := t.tx.Exec(ctx, query, args...)
+	return n, t.q.wrap(err)
+}
+
+func (t nodeTx) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := t.tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, t.q.wrap(err)
+	}
+	return nodeRows{rows, t.q}, nil
+}
+
+func (t nodeTx) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return nodeRow{t.tx.QueryRow(ctx, query, args...), t.q}
+}
+
+func (t nodeTx) Commit(ctx context.Context) error {
+	return t.q.wrap(t.tx.Commit(ctx))
+}
+
+// Rollback errors are not wrapped: callers ignore them, and database/sql
+// reports sql.ErrTxDone after a commit
+func (t nodeTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback(ctx)
+}
+
+type nodeRows struct {
+	Rows
+	q nodeQuerier
+}
+
+func (r nodeRows) Scan(dest ...any) error {
+	return r.q.wrap(r.Rows.Scan(dest...))
+}
+
+func (r nodeRows) Err() error {
+	return r.q.wrap(r.Rows.Err())
+}
+
+type nodeRow struct {
+	row Row
+	q   nodeQuerier
+}
+
+func (r nodeRow) Scan(dest ...any) error {
+	return r.q.wrap(r.row.Scan(dest...))
+}
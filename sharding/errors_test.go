@@ -0,0 +1,111 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapError_Classifies(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		kind      error
+		retryable bool
+	}{
+		{"unique violation", &pgconn.PgError{Code: "23505"}, ErrAlreadyExists, false},
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, ErrConflict, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, ErrConflict, true},
+		{"read-only transaction", &pgconn.PgError{Code: "25006"}, ErrReadOnly, false},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, ErrShardUnavailable, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, ErrShardUnavailable, true},
+		{"no rows", fmt.Errorf("failed to get user: %w", sql.ErrNoRows), ErrNotFound, false},
+		{"bad connection", sql.ErrConnDone, ErrShardUnavailable, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := WrapError(tt.err, 2, RoleReplica)
+
+			assert.ErrorIs(t, err, tt.kind)
+			assert.ErrorIs(t, err, tt.err, "The original error should stay reachable")
+			assert.Equal(t, tt.retryable, IsRetryable(err))
+
+			var shardErr *ShardError
+			require.ErrorAs(t, err, &shardErr)
+			assert.Equal(t, 2, shardErr.ShardID)
+			assert.Equal(t, RoleReplica, shardErr.Role)
+			assert.Contains(t, err.Error(), "shard 2 (replica)")
+		})
+	}
+}
+
+func TestWrapError_Permanent(t *testing.T) {
+	err := WrapError(&pgconn.PgError{Code: "42P01"}, 0, RolePrimary)
+
+	var shardErr *ShardError
+	require.ErrorAs(t, err, &shardErr)
+	assert.Equal(t, "42P01", shardErr.Code)
+	assert.False(t, IsRetryable(err))
+	for _, kind := range []error{ErrNotFound, ErrAlreadyExists, ErrConflict, ErrShardUnavailable, ErrReadOnly} {
+		assert.NotErrorIs(t, err, kind)
+	}
+
+	assert.Nil(t, WrapError(nil, 0, RolePrimary))
+	assert.False(t, IsRetryable(context.Canceled))
+	assert.True(t, IsRetryable(&StaleEpochError{ShardID: 1, Epoch: 1, CurrentEpoch: 2}))
+}
+
+func TestWrapError_KeepsInnermostShard(t *testing.T) {
+	inner := WrapError(&pgconn.PgError{Code: "23505"}, 1, RolePrimary)
+	outer := WrapError(fmt.Errorf("failed to create user: %w", inner), 0, RolePrimary)
+
+	var shardErr *ShardError
+	require.ErrorAs(t, outer, &shardErr)
+	assert.Equal(t, 1, shardErr.ShardID)
+}
+
+func TestUniqueViolationError_IsAlreadyExists(t *testing.T) {
+	var err error = &UniqueViolationError{Scope: "email", Value: "a@example.com", Owner: "user_1"}
+	assert.ErrorIs(t, err, ErrAlreadyExists)
+}
+
+// failingQuerier returns the same error from every operation
+type failingQuerier struct{ err error }
+
+func (q failingQuerier) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	return 0, q.err
+}
+func (q failingQuerier) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	return nil, q.err
+}
+func (q failingQuerier) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return failingRow(q)
+}
+func (q failingQuerier) Begin(ctx context.Context, opts TxOptions) (Tx, error) { return nil, q.err }
+func (q failingQuerier) Ping(ctx context.Context) error                        { return q.err }
+
+type failingRow failingQuerier
+
+func (r failingRow) Scan(dest ...any) error { return r.err }
+
+func TestNodeQuerier_WrapsErrors(t *testing.T) {
+	q := newNodeQuerier(failingQuerier{sql.ErrNoRows}, 1, RoleReplica)
+	ctx := context.Background()
+
+	_, err := q.Exec(ctx, "SELECT 1")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, q.QueryRow(ctx, "SELECT 1").Scan(), sql.ErrNoRows)
+
+	var shardErr *ShardError
+	require.ErrorAs(t, q.Ping(ctx), &shardErr)
+	assert.Equal(t, RoleReplica, shardErr.Role)
+
+	_, isBatcher := q.(Batcher)
+	assert.False(t, isBatcher)
+}
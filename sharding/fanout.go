@@ -0,0 +1,193 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FanOutPolicy decides how shard failures affect a scatter-gather query
+type FanOutPolicy int
+
+const (
+	// FailFast cancels the remaining shards and fails on the first shard error
+	FailFast FanOutPolicy = iota
+	// BestEffort queries every shard and reports per-shard errors
+	// It only fails if no shard answered
+	BestEffort
+	// Quorum queries every shard and fails if fewer than FanOutOptions.Quorum shards answered
+	Quorum
+)
+
+// FanOutOptions configures a scatter-gather query
+type FanOutOptions struct {
+	Policy FanOutPolicy
+
+	// Quorum is the number of shards that must answer under the Quorum policy
+	// Defaults to a majority of the queried shards; more than the queried shards is an error
+	Quorum int
+
+	// Concurrency limits how many shards are queried at once; 0 means all of them
+	Concurrency int
+
+	// ShardTimeout bounds each shard's query; 0 means no per-shard timeout
+	ShardTimeout time.Duration
+}
+
+// ShardResult is the outcome of a fan-out call on one shard
+type ShardResult[T any] struct {
+	ShardID  int
+	Value    T
+	Err      error
+	Duration time.Duration
+}
+
+// FanOutResult holds one result per queried shard, in the order the shards were given
+type FanOutResult[T any] struct {
+	Results []ShardResult[T]
+}
+
+// Answered returns the IDs of the shards that answered successfully
+func (r *FanOutResult[T]) Answered() []int {
+	var ids []int
+	for _, res := range r.Results {
+		if res.Err == nil {
+			ids = append(ids, res.ShardID)
+		}
+	}
+	return ids
+}
+
+// Failed returns the error of every shard that did not answer
+func (r *FanOutResult[T]) Failed() map[int]error {
+	failed := make(map[int]error)
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed[res.ShardID] = res.Err
+		}
+	}
+	return failed
+}
+
+// Complete reports whether every queried shard answered
+func (r *FanOutResult[T]) Complete() bool {
+	return len(r.Answered()) == len(r.Results)
+}
+
+// FanOut runs fn against every given shard concurrently and gathers the results
+// The returned result is always non-nil and says exactly which shards answered,
+// even when the policy turns the failures into an error
+// A FailFast error names its shard, so fn's errors need not.
+func FanOut[T any](ctx context.Context, shards []*Shard, opts FanOutOptions, fn func(ctx context.Context, shard *Shard) (T, error)) (*FanOutResult[T], error) {
+	result := &FanOutResult[T]{Results: make([]ShardResult[T], len(shards))}
+	for i, shard := range shards {
+		result.Results[i].ShardID = shard.ShardID
+	}
+
+	if opts.Policy == Quorum && opts.Quorum > len(shards) {
+		err := fmt.Errorf("quorum of %d can't be met by %d shards", opts.Quorum, len(shards))
+		for i := range result.Results {
+			result.Results[i].Err = err
+		}
+		return result, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 || concurrency > len(shards) {
+		concurrency = len(shards)
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	// fail records a shard's error; under FailFast the first one, including a
+	// cancellation seen before the shard ran, fails the fan-out and stops the rest
+	fail := func(res *ShardResult[T], err error) {
+		res.Err = err
+		if opts.Policy == FailFast {
+			once.Do(func() {
+				firstErr = withShard(err, res.ShardID)
+				cancel()
+			})
+		}
+	}
+
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard *Shard) {
+			defer wg.Done()
+
+			res := &result.Results[i]
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				fail(res, ctx.Err())
+				return
+			}
+
+			// A fail-fast fan-out may have been cancelled while waiting for a slot
+			if err := ctx.Err(); err != nil {
+				fail(res, err)
+				return
+			}
+
+			shardCtx := ctx
+			if opts.ShardTimeout > 0 {
+				var shardCancel context.CancelFunc
+				shardCtx, shardCancel = context.WithTimeout(ctx, opts.ShardTimeout)
+				defer shardCancel()
+			}
+
+			start := time.Now()
+			value, err := fn(shardCtx, shard)
+			res.Value, res.Duration = value, time.Since(start)
+			if err != nil {
+				fail(res, err)
+			}
+		}(i, shard)
+	}
+
+	wg.Wait()
+
+	switch opts.Policy {
+	case FailFast:
+		if firstErr != nil {
+			return result, firstErr
+		}
+	case BestEffort:
+		if len(shards) > 0 && len(result.Answered()) == 0 {
+			return result, fmt.Errorf("no shard answered: %v", result.Failed())
+		}
+	case Quorum:
+		quorum := opts.Quorum
+		if quorum <= 0 {
+			quorum = len(shards)/2 + 1
+		}
+		if answered := len(result.Answered()); answered < quorum {
+			return result, fmt.Errorf("quorum not met: %d of %d shards answered, need %d: %v",
+				answered, len(shards), quorum, result.Failed())
+		}
+	}
+
+	return result, nil
+}
+
+// withShard prefixes err with its shard, unless a *ShardError in it already names it
+func withShard(err error, shardID int) error {
+	var shardErr *ShardError
+	if errors.As(err, &shardErr) && shardErr.ShardID == shardID {
+		return err
+	}
+	return fmt.Errorf("shard %d: %w", shardID, err)
+}
@@ -0,0 +1,164 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeShards(n int) []*Shard {
+	shards := make([]*Shard, n)
+	for i := range shards {
+		shards[i] = &Shard{ShardID: i}
+	}
+	return shards
+}
+
+var errShardDown = errors.New("shard down")
+
+// failShards returns a fan-out function that fails on the given shards
+func failShards(ids ...int) func(ctx context.Context, shard *Shard) (int, error) {
+	return func(ctx context.Context, shard *Shard) (int, error) {
+		for _, id := range ids {
+			if shard.ShardID == id {
+				return 0, errShardDown
+			}
+		}
+		return shard.ShardID * 10, nil
+	}
+}
+
+func TestFanOut_AllAnswer(t *testing.T) {
+	result, err := FanOut(context.Background(), fakeShards(3), FanOutOptions{}, failShards())
+	require.NoError(t, err)
+	assert.True(t, result.Complete())
+	assert.Equal(t, []int{0, 1, 2}, result.Answered())
+	for i, res := range result.Results {
+		assert.Equal(t, i, res.ShardID, "Results should keep the shard order")
+		assert.Equal(t, i*10, res.Value)
+	}
+}
+
+func TestFanOut_FailFast(t *testing.T) {
+	result, err := FanOut(context.Background(), fakeShards(3), FanOutOptions{Policy: FailFast},
+		func(ctx context.Context, shard *Shard) (int, error) {
+			if shard.ShardID == 1 {
+				return 0, errShardDown
+			}
+			// The other shards only finish once the failure cancelled them
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, errShardDown)
+	assert.Contains(t, err.Error(), "shard 1")
+	assert.Empty(t, result.Answered())
+}
+
+func TestFanOut_BestEffort(t *testing.T) {
+	result, err := FanOut(context.Background(), fakeShards(3), FanOutOptions{Policy: BestEffort}, failShards(2))
+	require.NoError(t, err)
+	assert.False(t, result.Complete())
+	assert.Equal(t, []int{0, 1}, result.Answered())
+	assert.Equal(t, map[int]error{2: errShardDown}, result.Failed())
+
+	_, err = FanOut(context.Background(), fakeShards(2), FanOutOptions{Policy: BestEffort}, failShards(0, 1))
+	assert.Error(t, err, "BestEffort should fail when no shard answered")
+}
+
+func TestFanOut_Quorum(t *testing.T) {
+	// Default quorum is a majority: 2 of 3
+	result, err := FanOut(context.Background(), fakeShards(3), FanOutOptions{Policy: Quorum}, failShards(0))
+	require.NoError(t, err)
+	assert.Len(t, result.Answered(), 2)
+
+	result, err = FanOut(context.Background(), fakeShards(3), FanOutOptions{Policy: Quorum}, failShards(0, 1))
+	require.Error(t, err)
+	assert.Equal(t, []int{2}, result.Answered(), "The result should report who answered even on failure")
+
+	_, err = FanOut(context.Background(), fakeShards(3), FanOutOptions{Policy: Quorum, Quorum: 3}, failShards(0))
+	assert.Error(t, err)
+
+	// A quorum larger than the shards fails without querying them
+	called := false
+	result, err = FanOut(context.Background(), fakeShards(2), FanOutOptions{Policy: Quorum, Quorum: 3},
+		func(ctx context.Context, shard *Shard) (int, error) {
+			called = true
+			return 0, nil
+		})
+	require.Error(t, err)
+	assert.False(t, called)
+	assert.Empty(t, result.Answered())
+}
+
+func TestFanOut_FailFastCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	result, err := FanOut(ctx, fakeShards(3), FanOutOptions{Policy: FailFast, Concurrency: 1},
+		func(ctx context.Context, shard *Shard) (int, error) {
+			called = true
+			return 0, nil
+		})
+	require.Error(t, err, "Shards skipped by a cancelled context must fail the fan-out")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, called)
+	assert.Len(t, result.Failed(), 3)
+}
+
+func TestFanOut_NamesShardOnce(t *testing.T) {
+	_, err := FanOut(context.Background(), fakeShards(2), FanOutOptions{}, failShards(1))
+	assert.Equal(t, "shard 1: "+errShardDown.Error(), err.Error())
+
+	// Errors from a node already name their shard
+	shardErr := WrapError(errShardDown, 1, RoleReplica)
+	_, err = FanOut(context.Background(), fakeShards(2), FanOutOptions{},
+		func(ctx context.Context, shard *Shard) (int, error) {
+			if shard.ShardID == 1 {
+				return 0, fmt.Errorf("failed to query users: %w", shardErr)
+			}
+			return 0, nil
+		})
+	assert.Equal(t, "failed to query users: "+shardErr.Error(), err.Error())
+}
+
+func TestFanOut_ConcurrencyLimit(t *testing.T) {
+	var running, peak atomic.Int32
+
+	_, err := FanOut(context.Background(), fakeShards(8), FanOutOptions{Concurrency: 2},
+		func(ctx context.Context, shard *Shard) (int, error) {
+			now := running.Add(1)
+			for {
+				old := peak.Load()
+				if now <= old || peak.CompareAndSwap(old, now) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			return 0, nil
+		})
+	require.NoError(t, err)
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+}
+
+func TestFanOut_ShardTimeout(t *testing.T) {
+	result, err := FanOut(context.Background(), fakeShards(2), FanOutOptions{Policy: BestEffort, ShardTimeout: 10 * time.Millisecond},
+		func(ctx context.Context, shard *Shard) (int, error) {
+			if shard.ShardID == 0 {
+				<-ctx.Done()
+				return 0, ctx.Err()
+			}
+			return 1, nil
+		})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, result.Answered())
+	assert.ErrorIs(t, result.Failed()[0], context.DeadlineExceeded)
+}
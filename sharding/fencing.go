@@ -0,0 +1,98 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+)
+
+// maxStaleEpochRetries bounds how often a write is retried after a topology refresh
+const maxStaleEpochRetries = 3
+
+// StaleEpochError is returned when a write was routed with an older topology
+// than the one the shard primary has already been moved to
+type StaleEpochError struct {
+	ShardID      int
+	Epoch        int64
+	CurrentEpoch int64
+}
+
+func (e *StaleEpochError) Error() string {
+	return fmt.Sprintf("stale routing epoch for shard %d: routed with epoch %d, shard is at epoch %d",
+		e.ShardID, e.Epoch, e.CurrentEpoch)
+}
+
+// WithWriteTx runs fn in a transaction on the primary that owns shardKey
+// The manager's routing epoch is checked inside the transaction, so a write routed
+// with a stale topology can't commit. On a stale epoch the topology is refreshed
+// and fn is retried against the (possibly different) owning shard.
+// Managers built from a static configuration have epoch 0 and skip the check.
+// It is WithShardTx with the default isolation level.
+func (sm *ShardManager) WithWriteTx(ctx context.Context, shardKey string, fn func(tx *ShardTx) error) error {
+	return sm.WithShardTx(ctx, shardKey, TxOptions{}, fn)
+}
+
+// writeTxOnce runs a single fenced attempt of WithShardTx
+// committing reports whether the error came from the commit, whose outcome may be unknown.
+func (sm *ShardManager) writeTxOnce(ctx context.Context, shardKey string, opts TxOptions, fn func(tx *ShardTx) error) (committing bool, err error) {
+	// Take the primary and the epoch from the same topology
+	rt := sm.routing.Load()
+	shardID := rt.shardID(shardKey)
+	primary := rt.shards[shardID].PrimaryQuerier()
+	epoch := rt.version
+
+	tx, err := primary.Begin(ctx, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if epoch > 0 {
+		if err := checkEpoch(ctx, tx, shardID, epoch); err != nil {
+			return false, err
+		}
+	}
+
+	// Errors of fn that didn't come from the node still get the shard's context
+	if err := fn(&ShardTx{Tx: tx, ShardID: shardID, routing: rt}); err != nil {
+		return false, WrapError(err, shardID, RolePrimary)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return true, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return false, nil
+}
+
+// checkEpoch compares the routing epoch with the one stored on the shard primary
+// FOR SHARE holds off a concurrent epoch bump until this transaction ends
+func checkEpoch(ctx context.Context, tx Tx, shardID int, epoch int64) error {
+	var current int64
+	err := tx.QueryRow(ctx, `SELECT epoch FROM routing_epoch FOR SHARE`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read routing epoch on shard %d: %w", shardID, err)
+	}
+
+	if epoch < current {
+		return &StaleEpochError{ShardID: shardID, Epoch: epoch, CurrentEpoch: current}
+	}
+
+	return nil
+}
+
+// PublishEpoch stores the manager's topology version as the routing epoch on every primary
+// Run it after a topology change has been committed to the catalog; from then on,
+// writes routed with an older version are rejected by the shards
+func (sm *ShardManager) PublishEpoch(ctx context.Context) error {
+	epoch := sm.Version()
+
+	for _, shard := range sm.GetAllShards() {
+		_, err := shard.PrimaryQuerier().Exec(ctx,
+			`UPDATE routing_epoch SET epoch = $1 WHERE epoch < $1`, epoch)
+		if err != nil {
+			return fmt.Errorf("failed to publish epoch %d to shard %d: %w", epoch, shard.ShardID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleEpochError(t *testing.T) {
+	var err error = &StaleEpochError{ShardID: 1, Epoch: 3, CurrentEpoch: 4}
+	wrapped := errors.Join(errors.New("failed to create user"), err)
+
+	var stale *StaleEpochError
+	require.True(t, errors.As(wrapped, &stale))
+	assert.Equal(t, 1, stale.ShardID)
+	assert.Equal(t, int64(4), stale.CurrentEpoch)
+	assert.Contains(t, err.Error(), "epoch 3")
+}
+
+func TestShardManager_WithWriteTx_StaleEpoch(t *testing.T) {
+	ctx := context.Background()
+
+	cfg := config.DefaultConfig()
+	cfg.Version = 5
+	sm, err := NewShardManager(cfg)
+	require.NoError(t, err)
+	defer sm.Close()
+
+	shardKey := "fencing_test_user"
+	primary := sm.GetPrimaryDB(shardKey)
+
+	// Move the shard ahead of the manager's topology
+	_, err = primary.ExecContext(ctx, `UPDATE routing_epoch SET epoch = 6`)
+	require.NoError(t, err)
+
+	// PublishEpoch below moves every primary, so every primary is reset
+	defer func() {
+		for _, shard := range sm.GetAllShards() {
+			_, _ = shard.PrimaryQuerier().Exec(ctx, `UPDATE routing_epoch SET epoch = 0`)
+		}
+	}()
+
+	called := false
+	err = sm.WithWriteTx(ctx, shardKey, func(tx *ShardTx) error {
+		called = true
+		return nil
+	})
+
+	var stale *StaleEpochError
+	require.True(t, errors.As(err, &stale), "Write with an old epoch should be fenced")
+	assert.Equal(t, int64(5), stale.Epoch)
+	assert.Equal(t, int64(6), stale.CurrentEpoch)
+	assert.False(t, called, "Fenced write should never reach the callback")
+
+	// Publishing a newer epoch lets the manager write again
+	rt := *sm.routing.Load()
+	rt.version = 7
+	sm.routing.Store(&rt)
+	require.NoError(t, sm.PublishEpoch(ctx))
+	err = sm.WithWriteTx(ctx, shardKey, func(tx *ShardTx) error { return nil })
+	assert.NoError(t, err)
+}
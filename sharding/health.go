@@ -0,0 +1,304 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultRetireGrace         = 30 * time.Second
+	healthCheckTimeout         = 3 * time.Second
+)
+
+// StartupPolicy decides which nodes must be reachable when a shard manager starts
+type StartupPolicy int
+
+const (
+	// RequireAll fails startup if any primary or replica is unreachable
+	RequireAll StartupPolicy = iota
+	// RequirePrimaries fails startup only if a primary is unreachable
+	// Unreachable replicas are marked down and reads fall back to the primary
+	RequirePrimaries
+	// StartLazy never fails startup; every node is checked in the background
+	StartLazy
+)
+
+func (p StartupPolicy) String() string {
+	switch p {
+	case RequireAll:
+		return "require-all"
+	case RequirePrimaries:
+		return "require-primaries"
+	case StartLazy:
+		return "lazy"
+	default:
+		return fmt.Sprintf("StartupPolicy(%d)", int(p))
+	}
+}
+
+// checks reports whether nodes are pinged at startup
+func (p StartupPolicy) checks() bool {
+	return p != StartLazy
+}
+
+// requires reports whether an unreachable node of the given role fails startup
+func (p StartupPolicy) requires(role NodeRole) bool {
+	switch p {
+	case RequireAll:
+		return true
+	case RequirePrimaries:
+		return role == RolePrimary
+	default:
+		return false
+	}
+}
+
+// NodeRole is the role a node plays within its shard
+type NodeRole int
+
+const (
+	RolePrimary NodeRole = iota
+	RoleReplica
+)
+
+func (r NodeRole) String() string {
+	if r == RolePrimary {
+		return "primary"
+	}
+	return "replica"
+}
+
+// NodeState is the last known reachability of a node
+type NodeState int32
+
+const (
+	// NodeUnknown means the node has not been checked yet
+	NodeUnknown NodeState = iota
+	NodeUp
+	NodeDown
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeUp:
+		return "up"
+	case NodeDown:
+		return "down"
+	default:
+		return "unknown"
+	}
+}
+
+// node is a single database server together with its health
+// Exactly one of db and pool is set, depending on the backend
+type node struct {
+	addr string
+	cfg  config.DatabaseConfig
+	db   *sql.DB
+	pool *pgxpool.Pool
+	q    Querier
+	st   atomic.Int32
+
+	mu        sync.Mutex
+	lastErr   error
+	lastCheck time.Time
+}
+
+// openNode creates the connection pool for a node without contacting it
+// Errors returned through the node's Querier carry its shard and role.
+func openNode(cfg config.DatabaseConfig, shardID int, role NodeRole, opts Options) (*node, error) {
+	n := &node{
+		addr: fmt.Sprintf("%s:%d/%s", cfg.Host, cfg.Port, cfg.DBName),
+		cfg:  cfg,
+	}
+
+	if opts.Backend == BackendPgxPool {
+		poolCfg, err := pgxpool.ParseConfig(cfg.ConnectionString())
+		if err != nil {
+			return nil, err
+		}
+		poolCfg.AfterConnect = opts.AfterConnect
+		if opts.ConfigurePool != nil {
+			opts.ConfigurePool(poolCfg)
+		}
+
+		// pgxpool connects lazily, so this never blocks on an unreachable node
+		pool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
+		if err != nil {
+			return nil, err
+		}
+		n.pool = pool
+		n.q = newNodeQuerier(pgxQuerier{pool}, shardID, role)
+		return n, nil
+	}
+
+	db, err := sql.Open("pgx", cfg.ConnectionString())
+	if err != nil {
+		return nil, err
+	}
+	n.db = db
+	n.q = newNodeQuerier(sqlQuerier{db}, shardID, role)
+	return n, nil
+}
+
+// close closes the node's connection pool
+func (n *node) close() error {
+	if n.pool != nil {
+		n.pool.Close()
+		return nil
+	}
+	return n.db.Close()
+}
+
+// check pings the node and records the outcome
+func (n *node) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	err := n.q.Ping(ctx)
+
+	n.mu.Lock()
+	n.lastErr = err
+	n.lastCheck = time.Now()
+	n.mu.Unlock()
+
+	if err != nil {
+		n.st.Store(int32(NodeDown))
+	} else {
+		n.st.Store(int32(NodeUp))
+	}
+
+	return err
+}
+
+func (n *node) state() NodeState {
+	return NodeState(n.st.Load())
+}
+
+func (n *node) status(role NodeRole) NodeStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := NodeStatus{
+		Role:        role,
+		Address:     n.addr,
+		State:       n.state(),
+		LastChecked: n.lastCheck,
+	}
+	if n.lastErr != nil {
+		status.LastError = n.lastErr.Error()
+	}
+	return status
+}
+
+// healthChecker periodically pings every node so down nodes come back
+// and failing nodes are taken out of replica rotation
+type healthChecker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startHealthChecker(sm *ShardManager, interval time.Duration) *healthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	hc := &healthChecker{cancel: cancel, done: make(chan struct{})}
+
+	go func() {
+		defer close(hc.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sm.checkNodes()
+			}
+		}
+	}()
+
+	return hc
+}
+
+func (hc *healthChecker) stop() {
+	hc.cancel()
+	<-hc.done
+}
+
+// checkNodes pings every node of the current topology
+func (sm *ShardManager) checkNodes() {
+	for _, n := range sm.routing.Load().nodes {
+		n.check()
+	}
+}
+
+// NodeStatus describes the health of a single node
+type NodeStatus struct {
+	Role        NodeRole
+	Address     string
+	State       NodeState
+	LastError   string
+	LastChecked time.Time
+}
+
+// ShardStatus describes the health of a shard's nodes
+type ShardStatus struct {
+	ShardID  int
+	Primary  NodeStatus
+	Replicas []NodeStatus
+}
+
+// TopologyStatus reports the outcome of the startup policy and the current node health
+type TopologyStatus struct {
+	Version int64
+	Policy  StartupPolicy
+	Shards  []ShardStatus
+}
+
+// Degraded reports whether any node is currently known to be down
+func (ts TopologyStatus) Degraded() bool {
+	for _, shard := range ts.Shards {
+		if shard.Primary.State == NodeDown {
+			return true
+		}
+		for _, replica := range shard.Replicas {
+			if replica.State == NodeDown {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Status returns the health of every node in the current topology
+func (sm *ShardManager) Status() TopologyStatus {
+	rt := sm.routing.Load()
+
+	status := TopologyStatus{
+		Version: rt.version,
+		Policy:  sm.opts.Startup,
+		Shards:  make([]ShardStatus, 0, len(rt.shards)),
+	}
+
+	for _, shard := range rt.shards {
+		shardStatus := ShardStatus{
+			ShardID: shard.ShardID,
+			Primary: shard.primary.status(RolePrimary),
+		}
+		for _, replica := range shard.replicas {
+			shardStatus.Replicas = append(shardStatus.Replicas, replica.status(RoleReplica))
+		}
+		status.Shards = append(status.Shards, shardStatus)
+	}
+
+	return status
+}
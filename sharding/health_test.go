@@ -0,0 +1,139 @@
+package sharding
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableConfig returns a single-shard topology whose nodes refuse connections
+func unreachableConfig() *config.Config {
+	node := func(db string) config.DatabaseConfig {
+		return config.DatabaseConfig{Host: "127.0.0.1", Port: 1, User: "postgres", Password: "postgres", DBName: db}
+	}
+	return &config.Config{
+		Shards: []config.ShardConfig{
+			{ShardID: 0, Primary: node("primary"), Replicas: []config.DatabaseConfig{node("replica")}},
+		},
+	}
+}
+
+func TestShardManager_StartupPolicies(t *testing.T) {
+	_, err := NewShardManagerWithOptions(unreachableConfig(), Options{Startup: RequireAll})
+	assert.Error(t, err, "RequireAll should fail when a node is down")
+
+	_, err = NewShardManagerWithOptions(unreachableConfig(), Options{Startup: RequirePrimaries})
+	assert.Error(t, err, "RequirePrimaries should fail when a primary is down")
+
+	sm, err := NewShardManagerWithOptions(unreachableConfig(), Options{Startup: StartLazy})
+	require.NoError(t, err, "StartLazy should never fail on unreachable nodes")
+	defer sm.Close()
+
+	status := sm.Status()
+	assert.Equal(t, StartLazy, status.Policy)
+	assert.Equal(t, NodeUnknown, status.Shards[0].Primary.State)
+	assert.False(t, status.Degraded())
+}
+
+func TestShardManager_DownReplicaFallsBackToPrimary(t *testing.T) {
+	sm, err := NewShardManagerWithOptions(unreachableConfig(), Options{Startup: StartLazy})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	sm.checkNodes()
+
+	status := sm.Status()
+	require.Len(t, status.Shards[0].Replicas, 1)
+	assert.Equal(t, NodeDown, status.Shards[0].Replicas[0].State)
+	assert.NotEmpty(t, status.Shards[0].Replicas[0].LastError)
+	assert.True(t, status.Degraded())
+
+	// With its only replica down, reads go to the primary
+	assert.Same(t, sm.GetPrimaryDB("any_user"), sm.GetReplicaDB("any_user"))
+}
+
+func TestShardManager_Status(t *testing.T) {
+	sm, err := NewShardManagerWithOptions(config.DefaultConfig(), Options{Startup: RequirePrimaries})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	status := sm.Status()
+	assert.Len(t, status.Shards, sm.NumShards())
+	for _, shard := range status.Shards {
+		assert.Equal(t, NodeUp, shard.Primary.State)
+		assert.Equal(t, RolePrimary, shard.Primary.Role)
+	}
+}
+
+func TestShardManager_RetiredNodesCloseAfterGrace(t *testing.T) {
+	sm, err := NewShardManagerWithOptions(unreachableConfig(), Options{Startup: StartLazy, RetireGrace: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	old := sm.routing.Load().shards[0].replicas[0]
+
+	// Drop the replica from the topology
+	cfg := unreachableConfig()
+	cfg.Version++
+	cfg.Shards[0].Replicas = nil
+	require.NoError(t, sm.applyConfig(cfg))
+
+	// Readers of the previous snapshot can still use it for a while
+	assert.NotEqual(t, "sql: database is closed", pingError(old))
+
+	assert.Eventually(t, func() bool {
+		return pingError(old) == "sql: database is closed"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestShardManager_IgnoresOlderTopology(t *testing.T) {
+	cfg := unreachableConfig()
+	cfg.Version = 2
+	sm, err := NewShardManagerWithOptions(cfg, Options{Startup: StartLazy})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	for _, version := range []int64{1, 2} {
+		stale := unreachableConfig()
+		stale.Version = version
+		stale.Shards[0].Replicas = nil
+		require.NoError(t, sm.applyConfig(stale))
+	}
+
+	assert.Equal(t, int64(2), sm.Version())
+	assert.Len(t, sm.routing.Load().shards[0].replicas, len(cfg.Shards[0].Replicas))
+}
+
+func TestShardManager_FailoverReopensNode(t *testing.T) {
+	sm, err := NewShardManagerWithOptions(unreachableConfig(), Options{Startup: StartLazy})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	old := sm.routing.Load().shards[0].replicas[0]
+
+	// Promote the replica
+	cfg := unreachableConfig()
+	cfg.Version++
+	cfg.Shards[0].Primary, cfg.Shards[0].Replicas = cfg.Shards[0].Replicas[0], nil
+	require.NoError(t, sm.applyConfig(cfg))
+
+	primary := sm.routing.Load().shards[0].primary
+	assert.NotSame(t, old, primary)
+
+	var shardErr *ShardError
+	require.ErrorAs(t, primary.q.Ping(context.Background()), &shardErr)
+	assert.Equal(t, RolePrimary, shardErr.Role, "Errors should name the node's new role")
+}
+
+func pingError(n *node) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := n.db.PingContext(ctx); err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,213 @@
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AllShards is the ShardID of a resync that covers every shard
+const AllShards = -1
+
+// resyncRetryInterval is how often a resync owed to a subscriber that fell behind is retried
+const resyncRetryInterval = 10 * time.Millisecond
+
+// InvalidationChannel returns the NOTIFY channel a shard publishes changed keys on
+func InvalidationChannel(shardID int) string {
+	return fmt.Sprintf("invalidate_shard_%d", shardID)
+}
+
+// NotifyInvalidation announces that the keys changed; listeners are notified
+// when the transaction commits, and not at all if it rolls back
+func (tx *ShardTx) NotifyInvalidation(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, `SELECT pg_notify($1, key) FROM unnest($2::text[]) AS key`,
+		InvalidationChannel(tx.ShardID), keys)
+	if err != nil {
+		return fmt.Errorf("failed to notify invalidation: %w", err)
+	}
+	return nil
+}
+
+// Invalidation tells a subscriber that a key changed, or that it must resync
+type Invalidation struct {
+	ShardID int
+	Key     string
+
+	// Resync means notifications may have been missed, after a reconnect or
+	// because the subscriber fell behind: everything cached from ShardID (or
+	// from every shard, for AllShards) must be dropped. Key is empty.
+	Resync bool
+}
+
+// InvalidationListener holds a LISTEN session on every shard primary and fans
+// the notifications out to its subscribers
+type InvalidationListener struct {
+	sm *ShardManager
+
+	mu     sync.Mutex
+	subs   map[int]*invalidationSub
+	nextID int
+}
+
+type invalidationSub struct {
+	ch   chan Invalidation
+	done chan struct{}
+
+	// behind is set when a notification was dropped because ch was full, until
+	// the AllShards resync that replaces it is sent
+	behind bool
+}
+
+// NewInvalidationListener creates a listener for the shard manager's primaries
+func NewInvalidationListener(sm *ShardManager) *InvalidationListener {
+	return &InvalidationListener{sm: sm, subs: make(map[int]*invalidationSub)}
+}
+
+// Subscribe registers a subscriber with the given channel capacity
+// A subscriber that doesn't keep up loses notifications and receives an
+// AllShards resync once there is room again. The returned function unsubscribes.
+func (l *InvalidationListener) Subscribe(buffer int) (<-chan Invalidation, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := l.nextID
+	l.nextID++
+	sub := &invalidationSub{ch: make(chan Invalidation, buffer), done: make(chan struct{})}
+	l.subs[id] = sub
+
+	return sub.ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.subs[id]; ok {
+			delete(l.subs, id)
+			close(sub.done)
+		}
+	}
+}
+
+// publish delivers an invalidation to every subscriber without blocking
+func (l *InvalidationListener) publish(inv Invalidation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, sub := range l.subs {
+		// The resync is read after inv happened, so it covers inv as well
+		if sub.behind {
+			l.trySendResync(sub)
+			continue
+		}
+
+		select {
+		case sub.ch <- inv:
+		default:
+			sub.behind = true
+			go l.resyncWhenDrained(sub)
+		}
+	}
+}
+
+// trySendResync sends the resync a subscriber that fell behind is owed, if
+// there is room; l.mu must be held so no notification slips in between
+func (l *InvalidationListener) trySendResync(sub *invalidationSub) {
+	select {
+	case sub.ch <- Invalidation{ShardID: AllShards, Resync: true}:
+		sub.behind = false
+	default:
+	}
+}
+
+// resyncWhenDrained retries the resync until it is sent, so that it arrives
+// even if no further notification is published
+func (l *InvalidationListener) resyncWhenDrained(sub *invalidationSub) {
+	ticker := time.NewTicker(resyncRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		if sub.behind {
+			l.trySendResync(sub)
+		}
+		behind := sub.behind
+		l.mu.Unlock()
+		if !behind {
+			return
+		}
+	}
+}
+
+// Run listens on every shard primary until ctx is cancelled
+// Each session reconnects with backoff on failure and publishes a resync for
+// its shard once it is listening, so changes made while it was down are not missed.
+// The shards are taken from the topology when Run starts.
+func (l *InvalidationListener) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, shard := range l.sm.GetAllShards() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.watchShard(ctx, shard)
+		}()
+	}
+	wg.Wait()
+}
+
+func (l *InvalidationListener) watchShard(ctx context.Context, shard *Shard) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := l.listenShard(ctx, shard)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("invalidation listener: shard %d: %v (retrying in %s)", shard.ShardID, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// listenShard holds a single LISTEN session and returns when it fails
+func (l *InvalidationListener) listenShard(ctx context.Context, shard *Shard) error {
+	cfg := shard.PrimaryConfig()
+	conn, err := pgx.Connect(ctx, cfg.ConnectionString())
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	channel := InvalidationChannel(shard.ShardID)
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	l.publish(Invalidation{ShardID: shard.ShardID, Resync: true})
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		l.publish(Invalidation{ShardID: shard.ShardID, Key: n.Payload})
+	}
+}
@@ -0,0 +1,98 @@
+package sharding
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvalidationListener_Publish(t *testing.T) {
+	l := NewInvalidationListener(nil)
+	ch, unsubscribe := l.Subscribe(1)
+
+	l.publish(Invalidation{ShardID: 0, Key: "a"})
+	l.publish(Invalidation{ShardID: 0, Key: "b"}) // dropped: the buffer is full
+
+	assert.Equal(t, Invalidation{ShardID: 0, Key: "a"}, <-ch)
+
+	// The subscriber fell behind, so it is told to resync before anything else,
+	// even though nothing else is published
+	select {
+	case inv := <-ch:
+		assert.Equal(t, Invalidation{ShardID: AllShards, Resync: true}, inv)
+	case <-time.After(time.Second):
+		t.Fatal("the resync was not delivered")
+	}
+
+	l.publish(Invalidation{ShardID: 1, Key: "d"})
+	assert.Equal(t, Invalidation{ShardID: 1, Key: "d"}, <-ch)
+
+	unsubscribe()
+	l.publish(Invalidation{ShardID: 1, Key: "e"})
+	assert.Empty(t, ch)
+}
+
+func TestInvalidationListener_ResyncCoversLaterNotifications(t *testing.T) {
+	l := NewInvalidationListener(nil)
+	ch, unsubscribe := l.Subscribe(1)
+	defer unsubscribe()
+
+	l.publish(Invalidation{ShardID: 0, Key: "a"})
+	l.publish(Invalidation{ShardID: 0, Key: "b"}) // dropped: the buffer is full
+	l.publish(Invalidation{ShardID: 0, Key: "c"}) // dropped: covered by the resync
+
+	assert.Equal(t, Invalidation{ShardID: 0, Key: "a"}, <-ch)
+	assert.Equal(t, Invalidation{ShardID: AllShards, Resync: true}, <-ch)
+
+	l.publish(Invalidation{ShardID: 1, Key: "d"})
+	assert.Equal(t, Invalidation{ShardID: 1, Key: "d"}, <-ch)
+	assert.Empty(t, ch)
+}
+
+func TestInvalidationListener_Run(t *testing.T) {
+	sm, err := NewShardManager(config.DefaultConfig())
+	require.NoError(t, err)
+	defer sm.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l := NewInvalidationListener(sm)
+	ch, unsubscribe := l.Subscribe(16)
+	defer unsubscribe()
+	go l.Run(ctx)
+
+	key := "invalidation_user"
+	shardID := sm.GetShardID(key)
+
+	// Every session announces a resync once it is listening
+	for resynced := false; !resynced; {
+		select {
+		case inv := <-ch:
+			resynced = inv.Resync && inv.ShardID == shardID
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the listener")
+		}
+	}
+
+	err = sm.WithWriteTx(ctx, key, func(tx *ShardTx) error {
+		return tx.NotifyInvalidation(ctx, key)
+	})
+	require.NoError(t, err)
+
+	for {
+		select {
+		case inv := <-ch:
+			if inv.Key == key {
+				assert.Equal(t, shardID, inv.ShardID)
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the invalidation")
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Querier is the small set of operations the repository needs from a node
+// It is implemented on top of both database/sql and pgxpool, so repositories
+// work unchanged on either backend. "No rows" errors match sql.ErrNoRows
+// with errors.Is on both backends.
+type Querier interface {
+	Exec(ctx context.Context, query string, args ...any) (int64, error)
+	Query(ctx context.Context, query string, args ...any) (Rows, error)
+	QueryRow(ctx context.Context, query string, args ...any) Row
+	Begin(ctx context.Context, opts TxOptions) (Tx, error)
+	Ping(ctx context.Context) error
+}
+
+// Tx is a transaction started through a Querier
+type Tx interface {
+	Exec(ctx context.Context, query string, args ...any) (int64, error)
+	Query(ctx context.Context, query string, args ...any) (Rows, error)
+	QueryRow(ctx context.Context, query string, args ...any) Row
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+// Rows is the result of a query
+type Rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close()
+}
+
+// Row is the result of a single-row query
+type Row interface {
+	Scan(dest ...any) error
+}
+
+// Batcher is implemented by queriers that can pipeline several statements in one round trip
+// Only the pgxpool backend implements it
+type Batcher interface {
+	SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults
+}
+
+// IsolationLevel is the isolation level of a transaction
+type IsolationLevel int
+
+const (
+	// LevelDefault uses the server's default isolation level
+	LevelDefault IsolationLevel = iota
+	LevelReadCommitted
+	LevelRepeatableRead
+	LevelSerializable
+)
+
+// TxOptions configures a transaction started through a Querier
+type TxOptions struct {
+	Isolation IsolationLevel
+	ReadOnly  bool
+
+	// Idempotent tells WithShardTx that running fn again is safe even when an
+	// earlier attempt may have committed, for example because fn checks an
+	// idempotency key. Otherwise a transient error during the commit is not retried.
+	Idempotent bool
+}
+
+// Backend selects the driver used for node connection pools
+type Backend int
+
+const (
+	// BackendDatabaseSQL uses database/sql with the pgx stdlib driver
+	BackendDatabaseSQL Backend = iota
+	// BackendPgxPool uses a native pgxpool.Pool per node
+	BackendPgxPool
+)
+
+// sqlQuerier adapts *sql.DB to Querier
+type sqlQuerier struct {
+	db *sql.DB
+}
+
+// sqlExecutor is the part of the database/sql API shared by *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func sqlExec(ctx context.Context, e sqlExecutor, query string, args ...any) (int64, error) {
+	result, err := e.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func sqlQuery(ctx context.Context, e sqlExecutor, query string, args ...any) (Rows, error) {
+	rows, err := e.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlRows{rows}, nil
+}
+
+func (q sqlQuerier) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	return sqlExec(ctx, q.db, query, args...)
+}
+
+func (q sqlQuerier) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	return sqlQuery(ctx, q.db, query, args...)
+}
+
+func (q sqlQuerier) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return q.db.QueryRowContext(ctx, query, args...)
+}
+
+func (q sqlQuerier) Begin(ctx context.Context, opts TxOptions) (Tx, error) {
+	tx, err := q.db.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation.sqlLevel(), ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{tx}, nil
+}
+
+func (q sqlQuerier) Ping(ctx context.Context) error {
+	return q.db.PingContext(ctx)
+}
+
+// sqlTx adapts *sql.Tx to Tx
+type sqlTx struct {
+	tx *sql.Tx
+}
+
+func (t sqlTx) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	return sqlExec(ctx, t.tx, query, args...)
+}
+
+func (t sqlTx) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	return sqlQuery(ctx, t.tx, query, args...)
+}
+
+func (t sqlTx) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return t.tx.QueryRowContext(ctx, query, args...)
+}
+
+func (t sqlTx) Commit(ctx context.Context) error {
+	return t.tx.Commit()
+}
+
+func (t sqlTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback()
+}
+
+// sqlRows adapts *sql.Rows to Rows
+type sqlRows struct {
+	*sql.Rows
+}
+
+func (r sqlRows) Close() {
+	r.Rows.Close()
+}
+
+// pgxQuerier adapts *pgxpool.Pool to Querier
+type pgxQuerier struct {
+	pool *pgxpool.Pool
+}
+
+func (q pgxQuerier) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	tag, err := q.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (q pgxQuerier) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := q.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (q pgxQuerier) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return q.pool.QueryRow(ctx, query, args...)
+}
+
+func (q pgxQuerier) Begin(ctx context.Context, opts TxOptions) (Tx, error) {
+	txOpts := pgx.TxOptions{IsoLevel: opts.Isolation.pgxLevel()}
+	if opts.ReadOnly {
+		txOpts.AccessMode = pgx.ReadOnly
+	}
+
+	tx, err := q.pool.BeginTx(ctx, txOpts)
+	if err != nil {
+		return nil, err
+	}
+	return pgxTx{tx}, nil
+}
+
+func (q pgxQuerier) Ping(ctx context.Context) error {
+	return q.pool.Ping(ctx)
+}
+
+func (q pgxQuerier) SendBatch(ctx context.Context, batch *pgx.Batch) pgx.BatchResults {
+	return q.pool.SendBatch(ctx, batch)
+}
+
+// pgxTx adapts pgx.Tx to Tx
+type pgxTx struct {
+	tx pgx.Tx
+}
+
+func (t pgxTx) Exec(ctx context.Context, query string, args ...any) (int64, error) {
+	tag, err := t.tx.Exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (t pgxTx) Query(ctx context.Context, query string, args ...any) (Rows, error) {
+	rows, err := t.tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (t pgxTx) QueryRow(ctx context.Context, query string, args ...any) Row {
+	return t.tx.QueryRow(ctx, query, args...)
+}
+
+func (t pgxTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t pgxTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback(ctx)
+}
+
+func (l IsolationLevel) sqlLevel() sql.IsolationLevel {
+	switch l {
+	case LevelReadCommitted:
+		return sql.LevelReadCommitted
+	case LevelRepeatableRead:
+		return sql.LevelRepeatableRead
+	case LevelSerializable:
+		return sql.LevelSerializable
+	default:
+		return sql.LevelDefault
+	}
+}
+
+func (l IsolationLevel) pgxLevel() pgx.TxIsoLevel {
+	switch l {
+	case LevelReadCommitted:
+		return pgx.ReadCommitted
+	case LevelRepeatableRead:
+		return pgx.RepeatableRead
+	case LevelSerializable:
+		return pgx.Serializable
+	default:
+		return ""
+	}
+}
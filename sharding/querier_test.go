@@ -0,0 +1,67 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardManager_PgxPoolBackend_Lazy(t *testing.T) {
+	sm, err := NewShardManagerWithOptions(unreachableConfig(), Options{Startup: StartLazy, Backend: BackendPgxPool})
+	require.NoError(t, err, "pgxpool connects lazily, so a lazy start must succeed")
+	defer sm.Close()
+
+	shard, err := sm.GetShardByID(0)
+	require.NoError(t, err)
+	assert.NotNil(t, shard.PrimaryPool)
+	assert.Len(t, shard.ReplicaPools, 1)
+	assert.Nil(t, shard.Primary, "database/sql handles are not set on the pgxpool backend")
+	assert.Nil(t, sm.GetPrimaryDB("any_user"))
+
+	primary := sm.PrimaryQuerier("any_user")
+	require.NotNil(t, primary)
+	_, isBatcher := primary.(Batcher)
+	assert.True(t, isBatcher, "pgxpool queriers should support pipelining")
+}
+
+func TestIsolationLevelMapping(t *testing.T) {
+	assert.Equal(t, sql.LevelDefault, LevelDefault.sqlLevel())
+	assert.Equal(t, sql.LevelSerializable, LevelSerializable.sqlLevel())
+	assert.Equal(t, pgx.TxIsoLevel(""), LevelDefault.pgxLevel())
+	assert.Equal(t, pgx.RepeatableRead, LevelRepeatableRead.pgxLevel())
+}
+
+func TestShardManager_PgxPoolBackend(t *testing.T) {
+	ctx := context.Background()
+
+	var connected atomic.Int32
+	sm, err := NewShardManagerWithOptions(config.DefaultConfig(), Options{
+		Backend: BackendPgxPool,
+		AfterConnect: func(ctx context.Context, conn *pgx.Conn) error {
+			connected.Add(1)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	defer sm.Close()
+
+	assert.Greater(t, connected.Load(), int32(0), "AfterConnect should run for new connections")
+
+	var one int
+	err = sm.ReplicaQuerier("test_user_456").QueryRow(ctx, "SELECT 1").Scan(&one)
+	require.NoError(t, err)
+	assert.Equal(t, 1, one)
+
+	tx, err := sm.PrimaryQuerier("test_user_456").Begin(ctx, TxOptions{Isolation: LevelSerializable, ReadOnly: true})
+	require.NoError(t, err)
+	var isolation string
+	require.NoError(t, tx.QueryRow(ctx, "SHOW transaction_isolation").Scan(&isolation))
+	assert.Equal(t, "serializable", isolation)
+	require.NoError(t, tx.Rollback(ctx))
+}
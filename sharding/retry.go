@@ -0,0 +1,166 @@
+package sharding
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryAttempts    = 3
+	defaultRetryBaseDelay   = 20 * time.Millisecond
+	defaultRetryMaxDelay    = time.Second
+	defaultRetryBudgetRatio = 0.1
+	defaultRetryBudgetBurst = 10
+)
+
+// RetryPolicy controls how operations that hit a transient error (see IsRetryable) are retried
+type RetryPolicy struct {
+	// MaxAttempts bounds the tries of one operation, the first one included; defaults to 3
+	// Set it to 1 to disable retries.
+	MaxAttempts int
+
+	// BaseDelay is the backoff before the first retry; it doubles per retry up to
+	// MaxDelay, and each wait is drawn uniformly below it. Defaults to 20ms and 1s
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Budget caps retries across every operation of the manager; defaults to
+	// NewRetryBudget(0.1, 10)
+	Budget *RetryBudget
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.Budget == nil {
+		p.Budget = NewRetryBudget(defaultRetryBudgetRatio, defaultRetryBudgetBurst)
+	}
+	return p
+}
+
+// wait sleeps before the given retry (0 for the first) with full jitter
+func (p RetryPolicy) wait(ctx context.Context, retry int) error {
+	ceiling := p.MaxDelay
+	if retry < 31 {
+		ceiling = min(p.BaseDelay<<retry, p.MaxDelay)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rand.Int63n(int64(ceiling) + 1))):
+		return nil
+	}
+}
+
+// RetryBudget limits retries to a fraction of the operations, so that during an
+// outage retries can't multiply the load on the cluster
+// Every operation earns ratio tokens, up to burst; every retry spends one.
+type RetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+// NewRetryBudget creates a budget allowing ratio retries per operation, and
+// bursts of up to burst retries; it starts full
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+}
+
+// record earns the tokens of one operation
+func (b *RetryBudget) record() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, b.burst)
+}
+
+// spend takes a token for a retry and reports whether one was left
+func (b *RetryBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ReadReplica runs the read fn on a replica of the shard that owns shardKey
+// Transient errors fail over right away to the other replicas and then the
+// primary; once every node was tried, retries back off. fn may run several
+// times and must only read.
+func (sm *ShardManager) ReadReplica(ctx context.Context, shardKey string, fn func(q Querier) error) error {
+	rt := sm.routing.Load()
+	return sm.ReadShardReplica(ctx, rt.shards[rt.shardID(shardKey)], fn)
+}
+
+// ReadShardReplica is ReadReplica for a given shard
+func (sm *ShardManager) ReadShardReplica(ctx context.Context, shard *Shard, fn func(q Querier) error) error {
+	return sm.retryRead(ctx, shard.readNodes(), fn)
+}
+
+// ReadPrimary runs the read fn on the primary of the shard that owns shardKey,
+// retrying transient errors with backoff
+func (sm *ShardManager) ReadPrimary(ctx context.Context, shardKey string, fn func(q Querier) error) error {
+	rt := sm.routing.Load()
+	return sm.ReadShardPrimary(ctx, rt.shards[rt.shardID(shardKey)], fn)
+}
+
+// ReadShardPrimary is ReadPrimary for a given shard
+func (sm *ShardManager) ReadShardPrimary(ctx context.Context, shard *Shard, fn func(q Querier) error) error {
+	return sm.retryRead(ctx, []*node{shard.primary}, fn)
+}
+
+// retryRead runs fn on the nodes in turn until it succeeds, fails permanently,
+// or runs out of attempts or budget
+func (sm *ShardManager) retryRead(ctx context.Context, nodes []*node, fn func(q Querier) error) error {
+	policy := sm.opts.Retry
+	policy.Budget.record()
+
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if !IsRetryable(err) || !policy.Budget.spend() {
+				return err
+			}
+			if attempt >= len(nodes) {
+				if waitErr := policy.wait(ctx, attempt-len(nodes)); waitErr != nil {
+					return err
+				}
+			}
+		}
+
+		if err = fn(nodes[attempt%len(nodes)].q); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// readNodes lists the nodes a read may use, in order: the replica replicaNode
+// picks, the other replicas not known to be down, then the primary
+func (s *Shard) readNodes() []*node {
+	first := s.replicaNode()
+	nodes := []*node{first}
+	for _, replica := range s.replicas {
+		if replica != first && replica.state() != NodeDown {
+			nodes = append(nodes, replica)
+		}
+	}
+	if first != s.primary {
+		nodes = append(nodes, s.primary)
+	}
+	return nodes
+}
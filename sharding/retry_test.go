@@ -0,0 +1,101 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func retryManager(policy RetryPolicy) *ShardManager {
+	return &ShardManager{opts: Options{Retry: policy.withDefaults()}}
+}
+
+func retryShard(replicas int) *Shard {
+	shard := &Shard{ShardID: 1, primary: &node{addr: "primary", q: failingQuerier{errors.New("primary")}}}
+	for i := 0; i < replicas; i++ {
+		shard.replicas = append(shard.replicas, &node{addr: "replica", q: failingQuerier{fmt.Errorf("replica %d", i)}})
+	}
+	return shard
+}
+
+var errUnavailable = WrapError(&pgconn.PgError{Code: "57P01"}, 1, RoleReplica)
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(0.5, 2)
+
+	assert.True(t, budget.spend())
+	assert.True(t, budget.spend())
+	assert.False(t, budget.spend())
+
+	budget.record()
+	assert.False(t, budget.spend())
+	budget.record()
+	assert.True(t, budget.spend())
+}
+
+func TestRetryPolicy_WaitBounds(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}.withDefaults()
+
+	start := time.Now()
+	for retry := 0; retry < 10; retry++ {
+		require.NoError(t, policy.wait(context.Background(), retry))
+	}
+	assert.Less(t, time.Since(start), 10*5*time.Millisecond+time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	policy.MaxDelay = time.Hour
+	assert.ErrorIs(t, policy.wait(ctx, 20), context.Canceled)
+}
+
+func TestReadShardReplica_FailsOver(t *testing.T) {
+	sm := retryManager(RetryPolicy{MaxAttempts: 3})
+	shard := retryShard(2)
+
+	var used []Querier
+	err := sm.ReadShardReplica(context.Background(), shard, func(q Querier) error {
+		used = append(used, q)
+		if len(used) < 3 {
+			return errUnavailable
+		}
+		return nil
+	})
+
+	require.NoError(t, err)
+	require.Len(t, used, 3)
+	assert.NotEqual(t, used[0], used[1])
+	assert.Equal(t, shard.primary.q, used[2])
+}
+
+func TestReadShardReplica_PermanentErrorStops(t *testing.T) {
+	sm := retryManager(RetryPolicy{MaxAttempts: 3})
+	permanent := errors.New("syntax error")
+
+	calls := 0
+	err := sm.ReadShardReplica(context.Background(), retryShard(2), func(q Querier) error {
+		calls++
+		return permanent
+	})
+
+	assert.ErrorIs(t, err, permanent)
+	assert.Equal(t, 1, calls)
+}
+
+func TestReadShardPrimary_RetriesWithinBudget(t *testing.T) {
+	sm := retryManager(RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, Budget: NewRetryBudget(0, 2)})
+
+	calls := 0
+	err := sm.ReadShardPrimary(context.Background(), retryShard(0), func(q Querier) error {
+		calls++
+		return errUnavailable
+	})
+
+	assert.ErrorIs(t, err, ErrShardUnavailable)
+	assert.Equal(t, 3, calls, "the first try plus the two retries the budget allows")
+}
@@ -0,0 +1,386 @@
+package sharding
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSagaStepAttempts bounds how often a step is tried before the saga compensates
+	maxSagaStepAttempts = 3
+
+	// sagaRetryBaseDelay is the backoff before the second attempt of a step; it doubles per attempt
+	sagaRetryBaseDelay = 100 * time.Millisecond
+)
+
+// SagaState is the lifecycle state of a saga
+type SagaState string
+
+const (
+	SagaRunning      SagaState = "running"
+	SagaCompensating SagaState = "compensating"
+	SagaCompleted    SagaState = "completed"
+	SagaCompensated  SagaState = "compensated"
+)
+
+// SagaStep is one step of a saga; it writes to a single shard
+type SagaStep struct {
+	Name string
+
+	// ShardKey picks the shard the step writes to from the saga's payload
+	ShardKey func(payload []byte) string
+
+	// Action performs the step; Compensate undoes it and may be nil
+	// Both run in a transaction on the step's shard primary.
+	Action     func(ctx context.Context, tx *ShardTx, payload []byte) error
+	Compensate func(ctx context.Context, tx *ShardTx, payload []byte) error
+}
+
+// SagaAbortedError is returned by Run when a step failed and the saga was compensated
+type SagaAbortedError struct {
+	ID   string
+	Step string
+	Err  error
+}
+
+func (e *SagaAbortedError) Error() string {
+	return fmt.Sprintf("saga %s aborted at step %s: %v", e.ID, e.Step, e.Err)
+}
+
+func (e *SagaAbortedError) Unwrap() error { return e.Err }
+
+// SagaOrchestrator runs multi-shard operations as sagas: a sequence of shard-local
+// steps where a failure undoes the completed steps with their compensations.
+//
+// Saga state lives in the sagas table on the coordinator shard's primary and is
+// updated after every step. Every step records a marker in the saga_steps table
+// of its own shard in the same transaction as its writes, so a step retried after
+// a crash or a timeout is applied once, and compensations only undo steps that
+// actually committed. Recover resumes or compensates sagas whose orchestrator died.
+type SagaOrchestrator struct {
+	sm          *ShardManager
+	coordinator int
+
+	mu    sync.RWMutex
+	sagas map[string][]SagaStep
+}
+
+// NewSagaOrchestrator creates an orchestrator that keeps saga state on the given shard
+func NewSagaOrchestrator(sm *ShardManager, coordinatorShard int) *SagaOrchestrator {
+	return &SagaOrchestrator{
+		sm:          sm,
+		coordinator: coordinatorShard,
+		sagas:       make(map[string][]SagaStep),
+	}
+}
+
+// Register defines a saga type
+// Every process that may run or recover sagas of this type must register it.
+func (o *SagaOrchestrator) Register(name string, steps ...SagaStep) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.sagas[name] = steps
+}
+
+// Run starts a saga of a registered type and runs it to the end
+// It returns the saga's ID, and a *SagaAbortedError if the saga was compensated.
+// If ctx is cancelled or the coordinator can't be reached the saga is left
+// unfinished and Recover picks it up later.
+func (o *SagaOrchestrator) Run(ctx context.Context, name string, payload []byte) (string, error) {
+	if _, err := o.steps(name); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate saga ID: %w", err)
+	}
+	id := hex.EncodeToString(b)
+
+	db, err := o.coordinatorQuerier()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO sagas (id, saga_type, payload, state, step)
+		VALUES ($1, $2, $3, $4, 0)
+	`, id, name, payload, string(SagaRunning))
+	if err != nil {
+		return "", fmt.Errorf("failed to start saga %s: %w", name, err)
+	}
+
+	return id, o.execute(ctx, id, name, payload, SagaRunning, 0)
+}
+
+// State returns a saga's state and the number of steps it has completed
+// (while compensating: the number of steps that may still need compensation)
+func (o *SagaOrchestrator) State(ctx context.Context, id string) (SagaState, int, error) {
+	db, err := o.coordinatorQuerier()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var state string
+	var step int
+	err = db.QueryRow(ctx, `SELECT state, step FROM sagas WHERE id = $1`, id).Scan(&state, &step)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, fmt.Errorf("saga not found: %s", id)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get saga %s: %w", id, err)
+	}
+
+	return SagaState(state), step, nil
+}
+
+// execute drives a saga forward from the given state and step
+func (o *SagaOrchestrator) execute(ctx context.Context, id, name string, payload []byte, state SagaState, step int) error {
+	steps, err := o.steps(name)
+	if err != nil {
+		return err
+	}
+
+	var aborted *SagaAbortedError
+	if state == SagaRunning {
+		for ; step < len(steps); step++ {
+			if err := o.runStep(ctx, id, step, steps[step], payload, false); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+
+				// The failed step may have committed just before an error, so it is compensated too
+				aborted = &SagaAbortedError{ID: id, Step: steps[step].Name, Err: err}
+				state, step = SagaCompensating, step+1
+				if err := o.setState(ctx, id, state, step, err.Error()); err != nil {
+					return err
+				}
+				break
+			}
+
+			if err := o.setState(ctx, id, SagaRunning, step+1, ""); err != nil {
+				return err
+			}
+		}
+
+		if state == SagaRunning {
+			return o.setState(ctx, id, SagaCompleted, step, "")
+		}
+	}
+
+	for ; step > 0; step-- {
+		if err := o.runStep(ctx, id, step-1, steps[step-1], payload, true); err != nil {
+			// Left compensating; Recover retries it later
+			o.setState(ctx, id, SagaCompensating, step, err.Error())
+			return fmt.Errorf("failed to compensate step %s of saga %s: %w", steps[step-1].Name, id, err)
+		}
+		if err := o.setState(ctx, id, SagaCompensating, step-1, ""); err != nil {
+			return err
+		}
+	}
+
+	if err := o.setState(ctx, id, SagaCompensated, 0, ""); err != nil {
+		return err
+	}
+
+	if aborted == nil {
+		aborted = &SagaAbortedError{ID: id, Step: "recovery", Err: errors.New("compensated after a restart")}
+	}
+	return aborted
+}
+
+// runStep runs a step's action or compensation at most once, retrying failures
+func (o *SagaOrchestrator) runStep(ctx context.Context, id string, index int, step SagaStep, payload []byte, compensation bool) error {
+	fn := step.Action
+	if compensation {
+		fn = step.Compensate
+	}
+	if fn == nil {
+		return nil
+	}
+
+	var err error
+	for attempt := 0; attempt < maxSagaStepAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(sagaRetryBaseDelay << (attempt - 1)):
+			}
+		}
+
+		err = o.sm.WithWriteTx(ctx, step.ShardKey(payload), func(tx *ShardTx) error {
+			// Only undo actions that committed
+			if compensation {
+				done, err := stepDone(ctx, tx, id, index, false)
+				if err != nil || !done {
+					return err
+				}
+			}
+
+			done, err := stepDone(ctx, tx, id, index, compensation)
+			if err != nil || done {
+				return err
+			}
+
+			if err := fn(ctx, tx, payload); err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(ctx, `INSERT INTO saga_steps (saga_id, step, compensation) VALUES ($1, $2, $3)`,
+				id, index, compensation)
+			return err
+		})
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// stepDone reports whether a step's marker exists on the transaction's shard
+func stepDone(ctx context.Context, tx *ShardTx, id string, index int, compensation bool) (bool, error) {
+	var done bool
+	err := tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM saga_steps WHERE saga_id = $1 AND step = $2 AND compensation = $3)
+	`, id, index, compensation).Scan(&done)
+	return done, err
+}
+
+func (o *SagaOrchestrator) setState(ctx context.Context, id string, state SagaState, step int, lastError string) error {
+	db, err := o.coordinatorQuerier()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(ctx, `
+		UPDATE sagas
+		SET state = $2, step = $3, last_error = NULLIF($4, ''), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, string(state), step, lastError)
+	if err != nil {
+		return fmt.Errorf("failed to update saga %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// Recover resumes running sagas and finishes compensating ones whose state
+// hasn't changed for minAge, and returns how many it picked up. Each saga is
+// claimed by bumping its updated_at, so concurrent recovery workers don't run
+// the same saga; a saga whose type isn't registered is skipped.
+func (o *SagaOrchestrator) Recover(ctx context.Context, minAge time.Duration) (int, error) {
+	db, err := o.coordinatorQuerier()
+	if err != nil {
+		return 0, err
+	}
+
+	type pending struct {
+		id, name string
+		payload  []byte
+		state    string
+		step     int
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT id, saga_type, payload, state, step
+		FROM sagas
+		WHERE state IN ($1, $2) AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $3)
+	`, string(SagaRunning), string(SagaCompensating), minAge.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to list unfinished sagas: %w", err)
+	}
+	var sagas []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.name, &p.payload, &p.state, &p.step); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan saga: %w", err)
+		}
+		sagas = append(sagas, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating sagas: %w", err)
+	}
+
+	recovered := 0
+	for _, p := range sagas {
+		if _, err := o.steps(p.name); err != nil {
+			log.Printf("skipping saga %s: %v", p.id, err)
+			continue
+		}
+
+		claimed, err := db.Exec(ctx, `
+			UPDATE sagas SET updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND updated_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+		`, p.id, minAge.Seconds())
+		if err != nil {
+			return recovered, fmt.Errorf("failed to claim saga %s: %w", p.id, err)
+		}
+		if claimed == 0 {
+			continue
+		}
+
+		err = o.execute(ctx, p.id, p.name, p.payload, SagaState(p.state), p.step)
+		var aborted *SagaAbortedError
+		if err != nil && !errors.As(err, &aborted) {
+			log.Printf("failed to recover saga %s: %v", p.id, err)
+			continue
+		}
+		recovered++
+	}
+
+	return recovered, nil
+}
+
+// RunRecovery calls Recover every interval until ctx is cancelled
+// Failures are logged and retried on the next tick.
+func (o *SagaOrchestrator) RunRecovery(ctx context.Context, interval, minAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		recovered, err := o.Recover(ctx, minAge)
+		if err != nil {
+			log.Printf("saga recovery failed: %v", err)
+			continue
+		}
+		if recovered > 0 {
+			log.Printf("recovered %d unfinished sagas", recovered)
+		}
+	}
+}
+
+func (o *SagaOrchestrator) steps(name string) ([]SagaStep, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	steps, ok := o.sagas[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown saga type: %s", name)
+	}
+	return steps, nil
+}
+
+func (o *SagaOrchestrator) coordinatorQuerier() (Querier, error) {
+	shard, err := o.sm.GetShardByID(o.coordinator)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saga coordinator shard: %w", err)
+	}
+	return shard.PrimaryQuerier(), nil
+}
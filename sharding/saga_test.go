@@ -0,0 +1,113 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSagaAbortedError(t *testing.T) {
+	cause := errors.New("insufficient balance")
+	var err error = &SagaAbortedError{ID: "abc", Step: "debit", Err: cause}
+
+	assert.ErrorIs(t, err, cause)
+	assert.Contains(t, err.Error(), "debit")
+}
+
+// renameStep renames the user identified by the key, compensating back to "Before"
+func renameStep(key, name string) SagaStep {
+	return SagaStep{
+		Name:     "rename " + key,
+		ShardKey: func([]byte) string { return key },
+		Action: func(ctx context.Context, tx *ShardTx, payload []byte) error {
+			_, err := tx.Exec(ctx, `UPDATE users SET name = $1 WHERE user_id = $2`, name, key)
+			return err
+		},
+		Compensate: func(ctx context.Context, tx *ShardTx, payload []byte) error {
+			_, err := tx.Exec(ctx, `UPDATE users SET name = 'Before' WHERE user_id = $1`, key)
+			return err
+		},
+	}
+}
+
+func TestSagaOrchestrator_Completes(t *testing.T) {
+	sm, _, keys := setupTwoPhase(t)
+	ctx := context.Background()
+
+	o := NewSagaOrchestrator(sm, 0)
+	o.Register("rename_both", renameStep(keys[0], "Saga"), renameStep(keys[1], "Saga"))
+
+	id, err := o.Run(ctx, "rename_both", nil)
+	require.NoError(t, err)
+
+	state, step, err := o.State(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, SagaCompleted, state)
+	assert.Equal(t, 2, step)
+	for _, key := range keys {
+		assert.Equal(t, "Saga", nameOf(t, sm, key))
+	}
+}
+
+func TestSagaOrchestrator_Compensates(t *testing.T) {
+	sm, _, keys := setupTwoPhase(t)
+	ctx := context.Background()
+
+	attempts := 0
+	failing := SagaStep{
+		Name:     "fail",
+		ShardKey: func([]byte) string { return keys[1] },
+		Action: func(ctx context.Context, tx *ShardTx, payload []byte) error {
+			attempts++
+			return errors.New("step failed")
+		},
+	}
+
+	o := NewSagaOrchestrator(sm, 0)
+	o.Register("rename_then_fail", renameStep(keys[0], "Saga"), failing)
+
+	id, err := o.Run(ctx, "rename_then_fail", nil)
+	var aborted *SagaAbortedError
+	require.ErrorAs(t, err, &aborted)
+	assert.Equal(t, "fail", aborted.Step)
+	assert.Equal(t, maxSagaStepAttempts, attempts, "A failing step should be retried")
+
+	state, _, err := o.State(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, SagaCompensated, state)
+	assert.Equal(t, "Before", nameOf(t, sm, keys[0]))
+}
+
+func TestSagaOrchestrator_Recover(t *testing.T) {
+	sm, _, keys := setupTwoPhase(t)
+	ctx := context.Background()
+
+	o := NewSagaOrchestrator(sm, 0)
+	o.Register("rename_both", renameStep(keys[0], "Recovered"), renameStep(keys[1], "Recovered"))
+
+	// An orchestrator that died after persisting the saga, before running any step
+	db, err := o.coordinatorQuerier()
+	require.NoError(t, err)
+	_, err = db.Exec(ctx, `INSERT INTO sagas (id, saga_type, state, step) VALUES ('saga_recover_test', 'rename_both', 'running', 0)`)
+	require.NoError(t, err)
+	defer func() {
+		db.Exec(ctx, `DELETE FROM sagas WHERE id = 'saga_recover_test'`)
+		for _, key := range keys {
+			sm.GetPrimaryDB(key).Exec(`DELETE FROM saga_steps WHERE saga_id = 'saga_recover_test'`)
+		}
+	}()
+
+	recovered, err := o.Recover(ctx, 0)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, recovered, 1)
+
+	state, _, err := o.State(ctx, "saga_recover_test")
+	require.NoError(t, err)
+	assert.Equal(t, SagaCompleted, state)
+	for _, key := range keys {
+		assert.Equal(t, "Recovered", nameOf(t, sm, key))
+	}
+}
@@ -1,167 +1,433 @@
 package sharding
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"hash/fnv"
 	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/samandartukhtayev/replication-and-sharding/config"
 )
 
 // ShardManager manages database shards and their replicas
 type ShardManager struct {
-	shards    []*Shard
-	numShards int
-	mu        sync.RWMutex
+	// routing is the current topology snapshot
+	// Lookups load it without locking; topology changes swap in a new one
+	routing atomic.Pointer[routingTable]
+	opts    Options
+	catalog *catalogWatcher
+	health  *healthChecker
+
+	// applyMu serializes topology changes
+	applyMu sync.Mutex
+
+	// retired holds the nodes that left the topology until their grace period
+	// ends, with the timer that closes them; guarded by applyMu
+	retired map[*node]*time.Timer
+}
+
+// routingTable is an immutable snapshot of the topology
+// It is never modified after being published, so readers need no locks
+type routingTable struct {
+	shards  []*Shard
+	buckets []int
+	version int64
+
+	// nodes is keyed by nodeKey, as a node's errors name its shard and role
+	nodes map[string]*node
+}
+
+// nodeKey identifies a node across topologies
+// A DSN that changes shard or role, e.g. a replica promoted by a failover, gets a
+// new node so that its ShardErrors report where it serves now.
+func nodeKey(dsn string, shardID int, role NodeRole) string {
+	return fmt.Sprintf("%d/%s/%s", shardID, role, dsn)
 }
 
 // Shard represents a single database shard with primary and replica connections
+// Primary and Replicas are set for the database/sql backend,
+// PrimaryPool and ReplicaPools for the pgxpool backend
 type Shard struct {
 	ShardID  int
 	Primary  *sql.DB
 	Replicas []*sql.DB
+
+	PrimaryPool  *pgxpool.Pool
+	ReplicaPools []*pgxpool.Pool
+
+	primary  *node
+	replicas []*node
+}
+
+// Options controls how a shard manager connects to its nodes
+type Options struct {
+	// Startup decides which unreachable nodes fail the constructor
+	Startup StartupPolicy
+
+	// HealthCheckInterval is how often every node is pinged to update its state
+	// Defaults to 5 seconds
+	HealthCheckInterval time.Duration
+
+	// Backend selects database/sql (default) or a native pgxpool per node
+	Backend Backend
+
+	// AfterConnect runs on every new pgxpool connection (pgxpool backend only)
+	AfterConnect func(context.Context, *pgx.Conn) error
+
+	// ConfigurePool can adjust each node's pool settings, such as pool size,
+	// health check period or statement cache mode (pgxpool backend only)
+	ConfigurePool func(*pgxpool.Config)
+
+	// Retry controls retries of transient errors by the Read* helpers and WithShardTx
+	Retry RetryPolicy
+
+	// RetireGrace is how long connections to nodes that left the topology stay
+	// open for callers still using an earlier snapshot; defaults to 30 seconds
+	RetireGrace time.Duration
 }
 
 // NewShardManager creates a new shard manager with the given configuration
+// Every primary and replica must be reachable; see NewShardManagerWithOptions
 func NewShardManager(cfg *config.Config) (*ShardManager, error) {
+	return NewShardManagerWithOptions(cfg, Options{})
+}
+
+// NewShardManagerWithOptions creates a new shard manager with the given configuration and options
+// Nodes the startup policy tolerates as unreachable are marked down and retried in the background
+func NewShardManagerWithOptions(cfg *config.Config, opts Options) (*ShardManager, error) {
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if opts.RetireGrace <= 0 {
+		opts.RetireGrace = defaultRetireGrace
+	}
+	opts.Retry = opts.Retry.withDefaults()
+
 	sm := &ShardManager{
-		shards:    make([]*Shard, len(cfg.Shards)),
-		numShards: len(cfg.Shards),
+		opts:    opts,
+		retired: make(map[*node]*time.Timer),
+	}
+	sm.routing.Store(&routingTable{})
+
+	if err := sm.applyConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	sm.health = startHealthChecker(sm, opts.HealthCheckInterval)
+
+	return sm, nil
+}
+
+// applyConfig opens connections for the given topology and swaps it in
+// Connections to nodes that keep their shard and role in the new topology are reused.
+// Once a topology is in place, configs whose version isn't newer are ignored, so
+// concurrent refreshes can't move the manager back to an older version.
+func (sm *ShardManager) applyConfig(cfg *config.Config) error {
+	if err := validateConfig(cfg); err != nil {
+		return err
 	}
 
+	sm.applyMu.Lock()
+	defer sm.applyMu.Unlock()
+
+	current := sm.routing.Load()
+	if current.shards != nil && cfg.Version <= current.version {
+		return nil
+	}
+	nodes := make(map[string]*node)
+	open := func(dbCfg config.DatabaseConfig, shardID int, role NodeRole) (*node, error) {
+		key := nodeKey(dbCfg.ConnectionString(), shardID, role)
+		if n, ok := nodes[key]; ok {
+			return n, nil
+		}
+		if n, ok := current.nodes[key]; ok {
+			nodes[key] = n
+			return n, nil
+		}
+
+		n, err := openNode(dbCfg, shardID, role, sm.opts)
+		if err != nil {
+			return nil, err
+		}
+		nodes[key] = n
+
+		// The startup policy decides which nodes must answer right away
+		if !sm.opts.Startup.checks() {
+			return n, nil
+		}
+		if err := n.check(); err != nil && sm.opts.Startup.requires(role) {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	// closeNew closes connections opened for the new topology on failure
+	closeNew := func() {
+		for key, n := range nodes {
+			if _, ok := current.nodes[key]; !ok {
+				n.close()
+			}
+		}
+	}
+
+	shards := make([]*Shard, len(cfg.Shards))
+
 	// Initialize each shard with primary and replica connections
-	for i, shardCfg := range cfg.Shards {
+	for _, shardCfg := range cfg.Shards {
 		shard := &Shard{
 			ShardID:  shardCfg.ShardID,
 			Replicas: make([]*sql.DB, 0),
 		}
 
 		// Connect to primary
-		primaryDB, err := sql.Open("pgx", shardCfg.Primary.ConnectionString())
+		primary, err := open(shardCfg.Primary, shardCfg.ShardID, RolePrimary)
 		if err != nil {
-			return nil, fmt.Errorf("failed to connect to primary for shard %d: %w", shardCfg.ShardID, err)
-		}
-
-		// Test primary connection
-		if err := primaryDB.Ping(); err != nil {
-			return nil, fmt.Errorf("failed to ping primary for shard %d: %w", shardCfg.ShardID, err)
+			closeNew()
+			return fmt.Errorf("failed to connect to primary for shard %d: %w", shardCfg.ShardID, err)
 		}
-
-		shard.Primary = primaryDB
+		shard.Primary = primary.db
+		shard.PrimaryPool = primary.pool
+		shard.primary = primary
 
 		// Connect to replicas
 		for j, replicaCfg := range shardCfg.Replicas {
-			replicaDB, err := sql.Open("pgx", replicaCfg.ConnectionString())
+			replica, err := open(replicaCfg, shardCfg.ShardID, RoleReplica)
 			if err != nil {
-				return nil, fmt.Errorf("failed to connect to replica %d for shard %d: %w", j, shardCfg.ShardID, err)
+				closeNew()
+				return fmt.Errorf("failed to connect to replica %d for shard %d: %w", j, shardCfg.ShardID, err)
 			}
 
-			// Test replica connection
-			if err := replicaDB.Ping(); err != nil {
-				return nil, fmt.Errorf("failed to ping replica %d for shard %d: %w", j, shardCfg.ShardID, err)
+			if replica.db != nil {
+				shard.Replicas = append(shard.Replicas, replica.db)
+			} else {
+				shard.ReplicaPools = append(shard.ReplicaPools, replica.pool)
 			}
+			shard.replicas = append(shard.replicas, replica)
+		}
+
+		shards[shardCfg.ShardID] = shard
+	}
 
-			shard.Replicas = append(shard.Replicas, replicaDB)
+	sm.routing.Store(&routingTable{
+		shards:  shards,
+		buckets: append([]int(nil), cfg.Buckets...),
+		version: cfg.Version,
+		nodes:   nodes,
+	})
+
+	// Close connections to nodes that left the topology, or now serve another
+	// shard or role, once callers holding the previous snapshot are done with them
+	for key, n := range current.nodes {
+		if _, ok := nodes[key]; !ok {
+			sm.retire(n)
 		}
+	}
 
-		sm.shards[i] = shard
+	return nil
+}
+
+// retire closes a node that left the topology after the grace period
+// sm.applyMu must be held.
+func (sm *ShardManager) retire(n *node) {
+	sm.retired[n] = time.AfterFunc(sm.opts.RetireGrace, func() {
+		sm.applyMu.Lock()
+		defer sm.applyMu.Unlock()
+
+		// Close may have closed it already
+		if _, ok := sm.retired[n]; ok {
+			delete(sm.retired, n)
+			n.close()
+		}
+	})
+}
+
+// validateConfig checks that shard IDs are contiguous and buckets point at existing shards
+func validateConfig(cfg *config.Config) error {
+	if len(cfg.Shards) == 0 {
+		return fmt.Errorf("configuration has no shards")
 	}
 
-	return sm, nil
+	seen := make(map[int]bool, len(cfg.Shards))
+	for _, shardCfg := range cfg.Shards {
+		if shardCfg.ShardID < 0 || shardCfg.ShardID >= len(cfg.Shards) {
+			return fmt.Errorf("shard ID %d out of range [0, %d)", shardCfg.ShardID, len(cfg.Shards))
+		}
+		if seen[shardCfg.ShardID] {
+			return fmt.Errorf("duplicate shard ID: %d", shardCfg.ShardID)
+		}
+		seen[shardCfg.ShardID] = true
+	}
+
+	for bucket, shardID := range cfg.Buckets {
+		if !seen[shardID] {
+			return fmt.Errorf("bucket %d assigned to unknown shard %d", bucket, shardID)
+		}
+	}
+
+	return nil
 }
 
 // GetShardID calculates which shard a key belongs to using consistent hashing
 // This is the core sharding logic - we use FNV hash for deterministic shard selection
 func (sm *ShardManager) GetShardID(shardKey string) int {
+	return sm.routing.Load().shardID(shardKey)
+}
+
+// shardID maps a key to a shard of this snapshot
+func (rt *routingTable) shardID(shardKey string) int {
 	// Use FNV-1a hash function for good distribution
 	h := fnv.New32a()
 	h.Write([]byte(shardKey))
 	hashValue := h.Sum32()
 
+	// When the topology defines buckets, the hash picks a bucket
+	// and the bucket assignment picks the shard
+	if len(rt.buckets) > 0 {
+		return rt.buckets[int(hashValue)%len(rt.buckets)]
+	}
+
 	// Modulo operation to map hash to a shard
 	// This ensures the same key always goes to the same shard
-	shardID := int(hashValue) % sm.numShards
+	shardID := int(hashValue) % len(rt.shards)
 	return shardID
 }
 
 // GetPrimaryDB returns the primary database for a given shard key
 // All write operations should use this
+// Returns nil on the pgxpool backend; use PrimaryQuerier instead
 func (sm *ShardManager) GetPrimaryDB(shardKey string) *sql.DB {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	shardID := sm.GetShardID(shardKey)
-	return sm.shards[shardID].Primary
+	rt := sm.routing.Load()
+	return rt.shards[rt.shardID(shardKey)].Primary
 }
 
 // GetReplicaDB returns a replica database for a given shard key
 // Read operations can use this for load distribution
 // If no replicas are available, it returns the primary
 func (sm *ShardManager) GetReplicaDB(shardKey string) *sql.DB {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	rt := sm.routing.Load()
+	return rt.shards[rt.shardID(shardKey)].replicaNode().db
+}
 
-	shardID := sm.GetShardID(shardKey)
-	shard := sm.shards[shardID]
+// PrimaryQuerier returns the primary for a given shard key on either backend
+func (sm *ShardManager) PrimaryQuerier(shardKey string) Querier {
+	rt := sm.routing.Load()
+	return rt.shards[rt.shardID(shardKey)].primary.q
+}
 
-	// If no replicas available, fall back to primary
-	if len(shard.Replicas) == 0 {
-		return shard.Primary
+// ReplicaQuerier returns a replica for a given shard key on either backend
+// If no replicas are available, it returns the primary
+func (sm *ShardManager) ReplicaQuerier(shardKey string) Querier {
+	rt := sm.routing.Load()
+	return rt.shards[rt.shardID(shardKey)].replicaNode().q
+}
+
+// PrimaryQuerier returns the shard's primary on either backend
+func (s *Shard) PrimaryQuerier() Querier {
+	return s.primary.q
+}
+
+// PrimaryConfig returns the connection settings of the shard's primary
+// It is meant for dedicated sessions the pools can't provide, such as replication
+func (s *Shard) PrimaryConfig() config.DatabaseConfig {
+	return s.primary.cfg
+}
+
+// ReplicaQuerier returns one of the shard's replicas on either backend
+// If no replicas are available, it returns the primary
+func (s *Shard) ReplicaQuerier() Querier {
+	return s.replicaNode().q
+}
+
+// replicaNode picks a replica that is not known to be down
+// If no replicas are available, it returns the primary
+func (s *Shard) replicaNode() *node {
+	if len(s.replicas) == 0 {
+		return s.primary
 	}
 
-	// Randomly select a replica for load balancing
-	// In production, you might use round-robin or health-based selection
-	replicaIdx := rand.Intn(len(shard.Replicas))
-	return shard.Replicas[replicaIdx]
+	// Randomly select a replica for load balancing, skipping unhealthy ones
+	start := rand.Intn(len(s.replicas))
+	for i := range s.replicas {
+		replica := s.replicas[(start+i)%len(s.replicas)]
+		if replica.state() != NodeDown {
+			return replica
+		}
+	}
+
+	// If no replicas available, fall back to primary
+	return s.primary
 }
 
 // GetShardByID returns a specific shard by its ID
 // Useful for administrative operations or migrations
 func (sm *ShardManager) GetShardByID(shardID int) (*Shard, error) {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	rt := sm.routing.Load()
 
-	if shardID < 0 || shardID >= sm.numShards {
+	if shardID < 0 || shardID >= len(rt.shards) {
 		return nil, fmt.Errorf("invalid shard ID: %d", shardID)
 	}
 
-	return sm.shards[shardID], nil
+	return rt.shards[shardID], nil
 }
 
 // GetAllShards returns all shards
 // Useful for operations that need to run across all shards (e.g., migrations, analytics)
 func (sm *ShardManager) GetAllShards() []*Shard {
-	sm.mu.RLock()
-	defer sm.mu.RUnlock()
+	rt := sm.routing.Load()
 
 	// Return a copy to prevent external modifications
-	shardsCopy := make([]*Shard, len(sm.shards))
-	copy(shardsCopy, sm.shards)
+	shardsCopy := make([]*Shard, len(rt.shards))
+	copy(shardsCopy, rt.shards)
 	return shardsCopy
 }
 
 // Close closes all database connections
 func (sm *ShardManager) Close() error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	// Stop background work before tearing down connections
+	if sm.catalog != nil {
+		sm.catalog.stop()
+	}
+	if sm.health != nil {
+		sm.health.stop()
+	}
+
+	sm.applyMu.Lock()
+	defer sm.applyMu.Unlock()
 
 	var errs []error
 
-	for _, shard := range sm.shards {
-		if err := shard.Primary.Close(); err != nil {
+	for _, shard := range sm.routing.Load().shards {
+		if shard == nil {
+			continue
+		}
+
+		if err := shard.primary.close(); err != nil {
 			errs = append(errs, fmt.Errorf("failed to close primary for shard %d: %w", shard.ShardID, err))
 		}
 
-		for i, replica := range shard.Replicas {
-			if err := replica.Close(); err != nil {
+		for i, replica := range shard.replicas {
+			if err := replica.close(); err != nil {
 				errs = append(errs, fmt.Errorf("failed to close replica %d for shard %d: %w", i, shard.ShardID, err))
 			}
 		}
 	}
 
+	// Retired nodes don't wait for the end of their grace period
+	for n, timer := range sm.retired {
+		timer.Stop()
+		delete(sm.retired, n)
+		if err := n.close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close retired node %s: %w", n.addr, err))
+		}
+	}
+
 	if len(errs) > 0 {
 		return fmt.Errorf("errors closing connections: %v", errs)
 	}
@@ -171,5 +437,10 @@ func (sm *ShardManager) Close() error {
 
 // NumShards returns the total number of shards
 func (sm *ShardManager) NumShards() int {
-	return sm.numShards
+	return len(sm.routing.Load().shards)
+}
+
+// Version returns the topology version the manager is currently routing with
+func (sm *ShardManager) Version() int64 {
+	return sm.routing.Load().version
 }
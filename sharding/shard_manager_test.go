@@ -1,6 +1,7 @@
 package sharding
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/samandartukhtayev/replication-and-sharding/config"
@@ -127,3 +128,47 @@ func TestShardManager_GetAllShards(t *testing.T) {
 		assert.NotEmpty(t, shard.Replicas)
 	}
 }
+
+// benchmarkManager builds a manager that never contacts its nodes
+func benchmarkManager(b *testing.B) *ShardManager {
+	sm, err := NewShardManagerWithOptions(config.DefaultConfig(), Options{Startup: StartLazy})
+	require.NoError(b, err)
+	b.Cleanup(func() { sm.Close() })
+	return sm
+}
+
+func BenchmarkShardManager_GetPrimaryDB(b *testing.B) {
+	for _, goroutinesPerCPU := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("goroutines_per_cpu_%d", goroutinesPerCPU), func(b *testing.B) {
+			sm := benchmarkManager(b)
+			b.SetParallelism(goroutinesPerCPU)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					sm.GetPrimaryDB(benchmarkKeys[i%len(benchmarkKeys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkShardManager_GetReplicaDB(b *testing.B) {
+	sm := benchmarkManager(b)
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			sm.GetReplicaDB(benchmarkKeys[i%len(benchmarkKeys)])
+			i++
+		}
+	})
+}
+
+var benchmarkKeys = []string{"user_1", "user_2", "user_3", "user_100", "user_1000", "user_alice", "user_bob", "user_charlie"}
@@ -0,0 +1,124 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	// maxTxConflictRetries bounds how often a transaction is retried after
+	// a serialization failure or deadlock
+	maxTxConflictRetries = 5
+
+	// txRetryBaseDelay is the backoff before the first conflict retry; it doubles per retry
+	txRetryBaseDelay = 10 * time.Millisecond
+)
+
+// Postgres error codes of transactions that failed only because of concurrent ones
+const (
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+)
+
+// WrongShardError is returned when a transaction touches a key owned by another shard
+type WrongShardError struct {
+	Key     string
+	ShardID int
+	TxShard int
+}
+
+func (e *WrongShardError) Error() string {
+	return fmt.Sprintf("key %s belongs to shard %d, not to the transaction's shard %d", e.Key, e.ShardID, e.TxShard)
+}
+
+// ShardTx is a transaction on the primary of a single shard
+type ShardTx struct {
+	Tx
+	ShardID int
+
+	// routing is the topology the transaction was routed with
+	routing *routingTable
+}
+
+// CheckKey returns a *WrongShardError unless shardKey belongs to the transaction's shard
+// Call it for every shard key a transaction touches besides the one it was opened with.
+func (tx *ShardTx) CheckKey(shardKey string) error {
+	if shardID := tx.routing.shardID(shardKey); shardID != tx.ShardID {
+		return &WrongShardError{Key: shardKey, ShardID: shardID, TxShard: tx.ShardID}
+	}
+	return nil
+}
+
+// WithShardTx runs fn in a transaction on the primary that owns shardKey
+// The transaction uses the given isolation level and is fenced like WithWriteTx.
+// Serialization failures (40001) and deadlocks (40P01) roll the transaction back
+// and run fn again after a jittered exponential backoff, so fn must not have side
+// effects outside the transaction. Use tx.CheckKey to guard other keys fn touches.
+//
+// Other transient errors, such as a lost connection or a restarting primary, are
+// retried under the manager's RetryPolicy when that is provably safe: the
+// transaction failed before its commit was sent, the driver reports that nothing
+// was sent, or opts.Idempotent is set.
+func (sm *ShardManager) WithShardTx(ctx context.Context, shardKey string, opts TxOptions, fn func(tx *ShardTx) error) error {
+	staleRetries, conflictRetries, transientRetries := 0, 0, 0
+	policy := sm.opts.Retry
+	policy.Budget.record()
+
+	for {
+		committing, err := sm.writeTxOnce(ctx, shardKey, opts, fn)
+
+		var stale *StaleEpochError
+		switch {
+		case errors.As(err, &stale):
+			if staleRetries >= maxStaleEpochRetries {
+				return err
+			}
+			staleRetries++
+
+			if refreshErr := sm.Refresh(ctx); refreshErr != nil {
+				return fmt.Errorf("%w (refresh failed: %v)", err, refreshErr)
+			}
+
+		case isTxConflict(err):
+			if conflictRetries >= maxTxConflictRetries {
+				return err
+			}
+
+			// Full jitter keeps colliding transactions from retrying in lockstep
+			delay := time.Duration(rand.Int63n(int64(txRetryBaseDelay << conflictRetries)))
+			conflictRetries++
+
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+
+		case IsRetryable(err) && (!committing || pgconn.SafeToRetry(err) || opts.Idempotent):
+			if transientRetries+1 >= policy.MaxAttempts || !policy.Budget.spend() {
+				return err
+			}
+			if policy.wait(ctx, transientRetries) != nil {
+				return err
+			}
+			transientRetries++
+
+		default:
+			return err
+		}
+	}
+}
+
+// isTxConflict reports whether err is a serialization failure or a deadlock
+func isTxConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == pgSerializationFailure || pgErr.Code == pgDeadlockDetected
+}
@@ -0,0 +1,81 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardTx_CheckKey(t *testing.T) {
+	sm := routingOnlyManager(3, nil)
+	rt := sm.routing.Load()
+
+	key := "user_1"
+	tx := &ShardTx{ShardID: sm.GetShardID(key), routing: rt}
+	assert.NoError(t, tx.CheckKey(key))
+
+	// Find a key owned by another shard
+	var other string
+	for i := 0; other == ""; i++ {
+		if k := fmt.Sprintf("user_%d", i); sm.GetShardID(k) != tx.ShardID {
+			other = k
+		}
+	}
+
+	err := tx.CheckKey(other)
+	var wrong *WrongShardError
+	require.ErrorAs(t, err, &wrong)
+	assert.Equal(t, other, wrong.Key)
+	assert.Equal(t, tx.ShardID, wrong.TxShard)
+}
+
+func TestIsTxConflict(t *testing.T) {
+	assert.True(t, isTxConflict(fmt.Errorf("failed to commit: %w", &pgconn.PgError{Code: "40001"})))
+	assert.True(t, isTxConflict(&pgconn.PgError{Code: "40P01"}))
+	assert.False(t, isTxConflict(&pgconn.PgError{Code: "23505"}))
+	assert.False(t, isTxConflict(errors.New("connection reset")))
+	assert.False(t, isTxConflict(nil))
+}
+
+func TestShardManager_WithShardTx_RetriesConflicts(t *testing.T) {
+	ctx := context.Background()
+
+	sm, err := NewShardManager(config.DefaultConfig())
+	require.NoError(t, err)
+	defer sm.Close()
+
+	attempts := 0
+	err = sm.WithShardTx(ctx, "shard_tx_user", TxOptions{Isolation: LevelSerializable}, func(tx *ShardTx) error {
+		attempts++
+		if attempts < 3 {
+			return &pgconn.PgError{Code: pgSerializationFailure}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// Other errors are returned as they are
+	attempts = 0
+	err = sm.WithShardTx(ctx, "shard_tx_user", TxOptions{}, func(tx *ShardTx) error {
+		attempts++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// Give up after the retry limit
+	attempts = 0
+	err = sm.WithShardTx(ctx, "shard_tx_user", TxOptions{}, func(tx *ShardTx) error {
+		attempts++
+		return &pgconn.PgError{Code: pgDeadlockDetected}
+	})
+	assert.True(t, isTxConflict(err))
+	assert.Equal(t, maxTxConflictRetries+1, attempts)
+}
@@ -0,0 +1,61 @@
+package sharding
+
+import (
+	"fmt"
+	"time"
+)
+
+// Globally unique user IDs are Snowflake-style 63-bit integers:
+//
+//	| 41 bits: ms since IDEpoch | 10 bits: shard ID | 12 bits: per-shard sequence |
+//
+// IDs are generated on the shard primary by users_next_id(shard_id), which takes
+// the sequence bits from the shard's users_id_seq. Using the shard's own sequence
+// keeps IDs unique no matter how many application instances write to the shard.
+// The layout here must match that SQL function.
+const (
+	timestampBits = 41
+	shardIDBits   = 10
+	sequenceBits  = 12
+
+	// MaxShardID is the largest shard ID that fits in an ID
+	MaxShardID = 1<<shardIDBits - 1
+
+	shardIDShift   = sequenceBits
+	timestampShift = sequenceBits + shardIDBits
+	sequenceMask   = 1<<sequenceBits - 1
+
+	// MinID is the smallest generated ID; smaller ones are serial IDs from
+	// before the switch, whose zero timestamp bits would decode as shard 0
+	MinID = 1 << timestampShift
+)
+
+// IDEpoch is the zero point of the ID timestamp (2024-01-01T00:00:00Z)
+var IDEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ComposeID builds an ID from its parts
+func ComposeID(t time.Time, shardID int, sequence int64) (int64, error) {
+	if shardID < 0 || shardID > MaxShardID {
+		return 0, fmt.Errorf("shard ID %d does not fit in an ID", shardID)
+	}
+
+	ms := t.Sub(IDEpoch).Milliseconds()
+	if ms < 0 || ms >= 1<<timestampBits {
+		return 0, fmt.Errorf("time %s is outside the ID range", t)
+	}
+
+	return ms<<timestampShift | int64(shardID)<<shardIDShift | sequence&sequenceMask, nil
+}
+
+// DecodeID splits an ID into the time it was generated, its shard and its sequence
+func DecodeID(id int64) (t time.Time, shardID int, sequence int64) {
+	ms := id >> timestampShift
+	shardID = int(id>>shardIDShift) & MaxShardID
+	sequence = id & sequenceMask
+	return IDEpoch.Add(time.Duration(ms) * time.Millisecond), shardID, sequence
+}
+
+// ShardFromID returns the shard that generated an ID
+func ShardFromID(id int64) int {
+	return int(id>>shardIDShift) & MaxShardID
+}
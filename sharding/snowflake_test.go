@@ -0,0 +1,42 @@
+package sharding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComposeID_RoundTrip(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 30, 45, 123_000_000, time.UTC)
+
+	id, err := ComposeID(now, 2, 4097)
+	require.NoError(t, err)
+	assert.Positive(t, id)
+
+	ts, shardID, seq := DecodeID(id)
+	assert.True(t, now.Equal(ts))
+	assert.Equal(t, 2, shardID)
+	assert.Equal(t, int64(1), seq, "The sequence should wrap at 4096")
+	assert.Equal(t, 2, ShardFromID(id))
+}
+
+func TestComposeID_OrderedByTime(t *testing.T) {
+	now := time.Now()
+
+	a, err := ComposeID(now, MaxShardID, 4095)
+	require.NoError(t, err)
+	b, err := ComposeID(now.Add(time.Millisecond), 0, 0)
+	require.NoError(t, err)
+
+	assert.Less(t, a, b, "A later ID should sort after an earlier one regardless of shard and sequence")
+}
+
+func TestComposeID_OutOfRange(t *testing.T) {
+	_, err := ComposeID(time.Now(), MaxShardID+1, 0)
+	assert.Error(t, err)
+
+	_, err = ComposeID(IDEpoch.Add(-time.Millisecond), 0, 0)
+	assert.Error(t, err)
+}
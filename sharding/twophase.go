@@ -0,0 +1,415 @@
+package sharding
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// twoPhasePrefix marks the prepared transactions created by a TwoPhaseCoordinator
+// It is followed by the coordinator's log shard, so that a coordinator only
+// recovers transactions that its own log decides.
+const twoPhasePrefix = "tpc_"
+
+// States of a distributed transaction in the coordinator log
+// A transaction commits exactly when its row moves from preparing to committing;
+// both the coordinator and Recover move rows out of preparing with a
+// compare-and-set, so only one of them decides.
+const (
+	twoPhasePreparing  = "preparing"
+	twoPhaseCommitting = "committing"
+	twoPhaseAborting   = "aborting"
+)
+
+// Participant is one shard's part of a distributed transaction
+type Participant struct {
+	// ShardKey selects the shard; participants on the same shard share one transaction
+	ShardKey string
+
+	Fn func(ctx context.Context, tx *ShardTx) error
+}
+
+// TwoPhaseCoordinator runs transactions that span several shard primaries atomically
+// using PREPARE TRANSACTION / COMMIT PREPARED. Its decisions are kept in the
+// twophase_log table on the log shard's primary, so Recover can resolve
+// transactions left prepared by a crashed coordinator.
+//
+// Prepared transactions hold their locks until they are resolved, and require
+// max_prepared_transactions > 0 on every primary (and at least as much on replicas).
+// Coordinators with different log shards can run side by side: each one only
+// recovers the transactions it logs.
+type TwoPhaseCoordinator struct {
+	sm       *ShardManager
+	logShard int
+}
+
+// NewTwoPhaseCoordinator creates a coordinator that keeps its log on the given shard
+func NewTwoPhaseCoordinator(sm *ShardManager, logShard int) *TwoPhaseCoordinator {
+	return &TwoPhaseCoordinator{sm: sm, logShard: logShard}
+}
+
+// Execute runs every participant and commits all of them or none
+// Participants on a single shard run as a plain transaction. Otherwise every
+// shard's transaction is prepared in shard order, the commit decision is
+// logged, and the prepared transactions are committed. If a participant fails,
+// the ones already prepared are rolled back.
+//
+// Once the decision is logged the transaction counts as committed: a shard that
+// can't be reached for COMMIT PREPARED is finished later by Recover.
+// If the decision itself can't be confirmed the returned error says the
+// transaction is in doubt, and Recover settles it either way.
+func (c *TwoPhaseCoordinator) Execute(ctx context.Context, participants []Participant) error {
+	if len(participants) == 0 {
+		return nil
+	}
+
+	rt := c.sm.routing.Load()
+	groups := make(map[int][]Participant)
+	for _, p := range participants {
+		shardID := rt.shardID(p.ShardKey)
+		groups[shardID] = append(groups[shardID], p)
+	}
+
+	if len(groups) == 1 {
+		return c.sm.WithShardTx(ctx, participants[0].ShardKey, TxOptions{}, func(tx *ShardTx) error {
+			return runParticipants(ctx, tx, participants)
+		})
+	}
+
+	// A fixed order keeps two distributed transactions from waiting on each other's shards
+	shardIDs := make([]int, 0, len(groups))
+	for shardID := range groups {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Ints(shardIDs)
+
+	gid, err := newGID(c.gidPrefix())
+	if err != nil {
+		return err
+	}
+
+	logDB, err := c.logQuerier()
+	if err != nil {
+		return err
+	}
+
+	shards := make([]int32, len(shardIDs))
+	for i, shardID := range shardIDs {
+		shards[i] = int32(shardID)
+	}
+	_, err = logDB.Exec(ctx, `INSERT INTO twophase_log (gid, state, shards) VALUES ($1, $2, $3)`,
+		gid, twoPhasePreparing, shards)
+	if err != nil {
+		return fmt.Errorf("failed to log transaction %s: %w", gid, err)
+	}
+
+	var prepared []int
+	for _, shardID := range shardIDs {
+		if err := prepareParticipants(ctx, rt, shardID, gid, groups[shardID]); err != nil {
+			c.abort(ctx, gid, prepared)
+			return fmt.Errorf("failed to prepare transaction %s on shard %d: %w", gid, shardID, err)
+		}
+		prepared = append(prepared, shardID)
+	}
+
+	// The commit point
+	decided, err := logDB.Exec(ctx, `UPDATE twophase_log SET state = $2 WHERE gid = $1 AND state = $3`,
+		gid, twoPhaseCommitting, twoPhasePreparing)
+	if err != nil {
+		return fmt.Errorf("transaction %s is in doubt, Recover will resolve it: %w", gid, err)
+	}
+	if decided == 0 {
+		// Recover took the coordinator for dead and aborted the transaction
+		c.abort(ctx, gid, prepared)
+		return fmt.Errorf("transaction %s was aborted by recovery", gid)
+	}
+
+	c.finish(ctx, gid, prepared, true)
+	return nil
+}
+
+// runParticipants runs the participants of one shard in order
+func runParticipants(ctx context.Context, tx *ShardTx, participants []Participant) error {
+	for _, p := range participants {
+		if err := p.Fn(ctx, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareParticipants runs one shard's participants and prepares their transaction
+func prepareParticipants(ctx context.Context, rt *routingTable, shardID int, gid string, participants []Participant) error {
+	tx, err := rt.shards[shardID].PrimaryQuerier().Begin(ctx, TxOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// After PREPARE the session has no transaction left; this only returns the connection
+	defer tx.Rollback(context.WithoutCancel(ctx))
+
+	if rt.version > 0 {
+		if err := checkEpoch(ctx, tx, shardID, rt.version); err != nil {
+			return err
+		}
+	}
+
+	if err := runParticipants(ctx, &ShardTx{Tx: tx, ShardID: shardID, routing: rt}, participants); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `PREPARE TRANSACTION `+quoteLiteral(gid)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// abort records the abort decision and rolls back the prepared transactions
+func (c *TwoPhaseCoordinator) abort(ctx context.Context, gid string, prepared []int) {
+	ctx = context.WithoutCancel(ctx)
+
+	logDB, err := c.logQuerier()
+	if err == nil {
+		_, err = logDB.Exec(ctx, `UPDATE twophase_log SET state = $2 WHERE gid = $1 AND state = $3`,
+			gid, twoPhaseAborting, twoPhasePreparing)
+	}
+	if err != nil {
+		log.Printf("failed to log abort of transaction %s: %v", gid, err)
+	}
+
+	c.finish(ctx, gid, prepared, false)
+}
+
+// finish commits or rolls back the prepared transactions and drops the log row
+// The row is kept when a shard failed, so Recover retries it.
+func (c *TwoPhaseCoordinator) finish(ctx context.Context, gid string, shardIDs []int, commit bool) {
+	ctx = context.WithoutCancel(ctx)
+
+	done := true
+	for _, shardID := range shardIDs {
+		if err := c.resolve(ctx, shardID, gid, commit); err != nil {
+			log.Printf("failed to resolve transaction %s on shard %d: %v", gid, shardID, err)
+			done = false
+		}
+	}
+	if !done {
+		return
+	}
+
+	logDB, err := c.logQuerier()
+	if err == nil {
+		_, err = logDB.Exec(ctx, `DELETE FROM twophase_log WHERE gid = $1`, gid)
+	}
+	if err != nil {
+		log.Printf("failed to remove transaction %s from the log: %v", gid, err)
+	}
+}
+
+// resolve commits or rolls back gid on one shard if it is still prepared there
+func (c *TwoPhaseCoordinator) resolve(ctx context.Context, shardID int, gid string, commit bool) error {
+	shard, err := c.sm.GetShardByID(shardID)
+	if err != nil {
+		return err
+	}
+	db := shard.PrimaryQuerier()
+
+	var exists bool
+	err = db.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_prepared_xacts WHERE gid = $1 AND database = current_database())
+	`, gid).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	stmt := `ROLLBACK PREPARED `
+	if commit {
+		stmt = `COMMIT PREPARED `
+	}
+	_, err = db.Exec(ctx, stmt+quoteLiteral(gid))
+	return err
+}
+
+// Recover resolves distributed transactions left behind by crashed coordinators
+// and returns how many it resolved. Only transactions older than minAge are
+// touched, which leaves running ones alone. Logged transactions still preparing
+// are aborted, committing ones are committed on every shard, and prepared
+// transactions without a log row are rolled back (their coordinator never got
+// past preparing). Transactions of coordinators logging on another shard are
+// left to them.
+func (c *TwoPhaseCoordinator) Recover(ctx context.Context, minAge time.Duration) (int, error) {
+	logDB, err := c.logQuerier()
+	if err != nil {
+		return 0, err
+	}
+
+	type entry struct {
+		gid    string
+		state  string
+		shards string
+	}
+
+	// Arrays are read as text, which every backend can scan
+	rows, err := logDB.Query(ctx, `
+		SELECT gid, state, array_to_string(shards, ',')
+		FROM twophase_log
+		WHERE created_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+	`, minAge.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the coordinator log: %w", err)
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.gid, &e.state, &e.shards); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan the coordinator log: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating the coordinator log: %w", err)
+	}
+
+	resolved := 0
+	for _, e := range entries {
+		if e.state == twoPhasePreparing {
+			aborted, err := logDB.Exec(ctx, `UPDATE twophase_log SET state = $2 WHERE gid = $1 AND state = $3`,
+				e.gid, twoPhaseAborting, twoPhasePreparing)
+			if err != nil {
+				return resolved, fmt.Errorf("failed to abort transaction %s: %w", e.gid, err)
+			}
+			if aborted == 0 {
+				// The coordinator decided in the meantime; pick it up next time
+				continue
+			}
+			e.state = twoPhaseAborting
+		}
+
+		var shardIDs []int
+		for _, field := range strings.Split(e.shards, ",") {
+			shardID, err := strconv.Atoi(field)
+			if err != nil {
+				return resolved, fmt.Errorf("invalid shard list %q for transaction %s", e.shards, e.gid)
+			}
+			shardIDs = append(shardIDs, shardID)
+		}
+		c.finish(ctx, e.gid, shardIDs, e.state == twoPhaseCommitting)
+		resolved++
+	}
+
+	// Prepared transactions the log doesn't know about
+	for _, shard := range c.sm.GetAllShards() {
+		gids, err := preparedGIDs(ctx, shard.PrimaryQuerier(), c.gidPrefix(), minAge)
+		if err != nil {
+			return resolved, fmt.Errorf("failed to list prepared transactions on shard %d: %w", shard.ShardID, err)
+		}
+
+		for _, gid := range gids {
+			var state string
+			err := logDB.QueryRow(ctx, `SELECT state FROM twophase_log WHERE gid = $1`, gid).Scan(&state)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return resolved, fmt.Errorf("failed to read the coordinator log: %w", err)
+			}
+
+			if err := c.resolve(ctx, shard.ShardID, gid, false); err != nil {
+				return resolved, fmt.Errorf("failed to roll back transaction %s on shard %d: %w", gid, shard.ShardID, err)
+			}
+			resolved++
+		}
+	}
+
+	return resolved, nil
+}
+
+// RunRecovery calls Recover every interval until ctx is cancelled
+// Failures are logged and retried on the next tick.
+func (c *TwoPhaseCoordinator) RunRecovery(ctx context.Context, interval, minAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resolved, err := c.Recover(ctx, minAge)
+		if err != nil {
+			log.Printf("two-phase commit recovery failed: %v", err)
+			continue
+		}
+		if resolved > 0 {
+			log.Printf("resolved %d in-doubt distributed transactions", resolved)
+		}
+	}
+}
+
+// preparedGIDs lists the prepared transactions with the given gid prefix older than minAge
+func preparedGIDs(ctx context.Context, db Querier, prefix string, minAge time.Duration) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT gid
+		FROM pg_prepared_xacts
+		WHERE database = current_database()
+		  AND starts_with(gid, $1)
+		  AND prepared < now() - make_interval(secs => $2)
+	`, prefix, minAge.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gids []string
+	for rows.Next() {
+		var gid string
+		if err := rows.Scan(&gid); err != nil {
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+
+	return gids, rows.Err()
+}
+
+func (c *TwoPhaseCoordinator) logQuerier() (Querier, error) {
+	shard, err := c.sm.GetShardByID(c.logShard)
+	if err != nil {
+		return nil, fmt.Errorf("invalid coordinator log shard: %w", err)
+	}
+	return shard.PrimaryQuerier(), nil
+}
+
+// gidPrefix starts the global transaction identifiers of this coordinator
+func (c *TwoPhaseCoordinator) gidPrefix() string {
+	return fmt.Sprintf("%s%d_", twoPhasePrefix, c.logShard)
+}
+
+// newGID returns a random global transaction identifier with the given prefix
+func newGID(prefix string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate transaction ID: %w", err)
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// quoteLiteral quotes s as an SQL string literal
+// PREPARE TRANSACTION and COMMIT/ROLLBACK PREPARED don't accept parameters
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,140 @@
+package sharding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/samandartukhtayev/replication-and-sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGID(t *testing.T) {
+	coord := NewTwoPhaseCoordinator(nil, 2)
+	a, err := newGID(coord.gidPrefix())
+	require.NoError(t, err)
+	b, err := newGID(coord.gidPrefix())
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(a, "tpc_2_"))
+	assert.NotEqual(t, a, b)
+
+	// Coordinators logging elsewhere can't claim each other's transactions
+	assert.False(t, strings.HasPrefix(a, NewTwoPhaseCoordinator(nil, 1).gidPrefix()))
+	assert.False(t, strings.HasPrefix(a, NewTwoPhaseCoordinator(nil, 20).gidPrefix()))
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	assert.Equal(t, `'tpc_1'`, quoteLiteral("tpc_1"))
+	assert.Equal(t, `'it''s'`, quoteLiteral("it's"))
+}
+
+// keysOnDistinctShards returns one key for each of the first n shards
+func keysOnDistinctShards(sm *ShardManager, n int) []string {
+	keys := make([]string, n)
+	found := 0
+	for i := 0; found < n; i++ {
+		key := fmt.Sprintf("tpc_user_%d", i)
+		if shardID := sm.GetShardID(key); shardID < n && keys[shardID] == "" {
+			keys[shardID] = key
+			found++
+		}
+	}
+	return keys
+}
+
+func setupTwoPhase(t *testing.T) (*ShardManager, *TwoPhaseCoordinator, []string) {
+	sm, err := NewShardManager(config.DefaultConfig())
+	require.NoError(t, err)
+
+	keys := keysOnDistinctShards(sm, 2)
+	for _, key := range keys {
+		_, err := sm.GetPrimaryDB(key).Exec(
+			`INSERT INTO users (user_id, name, email) VALUES ($1, 'Before', $1 || '@example.com')
+			 ON CONFLICT (user_id) DO UPDATE SET name = 'Before'`, key)
+		require.NoError(t, err)
+	}
+
+	t.Cleanup(func() {
+		for _, key := range keys {
+			sm.GetPrimaryDB(key).Exec(`DELETE FROM users WHERE user_id = $1`, key)
+		}
+		sm.Close()
+	})
+
+	return sm, NewTwoPhaseCoordinator(sm, 0), keys
+}
+
+func rename(key, name string) Participant {
+	return Participant{
+		ShardKey: key,
+		Fn: func(ctx context.Context, tx *ShardTx) error {
+			_, err := tx.Exec(ctx, `UPDATE users SET name = $1 WHERE user_id = $2`, name, key)
+			return err
+		},
+	}
+}
+
+func nameOf(t *testing.T, sm *ShardManager, key string) string {
+	var name string
+	require.NoError(t, sm.GetPrimaryDB(key).QueryRow(`SELECT name FROM users WHERE user_id = $1`, key).Scan(&name))
+	return name
+}
+
+func TestTwoPhaseCoordinator_Commit(t *testing.T) {
+	sm, coord, keys := setupTwoPhase(t)
+	ctx := context.Background()
+
+	err := coord.Execute(ctx, []Participant{rename(keys[0], "After"), rename(keys[1], "After")})
+	require.NoError(t, err)
+
+	for _, key := range keys {
+		assert.Equal(t, "After", nameOf(t, sm, key))
+	}
+}
+
+func TestTwoPhaseCoordinator_Abort(t *testing.T) {
+	sm, coord, keys := setupTwoPhase(t)
+	ctx := context.Background()
+
+	failing := Participant{
+		ShardKey: keys[1],
+		Fn: func(ctx context.Context, tx *ShardTx) error {
+			return errors.New("participant failed")
+		},
+	}
+
+	err := coord.Execute(ctx, []Participant{rename(keys[0], "After"), failing})
+	require.Error(t, err)
+
+	// The first shard was prepared, then rolled back
+	assert.Equal(t, "Before", nameOf(t, sm, keys[0]))
+}
+
+func TestTwoPhaseCoordinator_RecoverUnloggedPrepared(t *testing.T) {
+	sm, coord, keys := setupTwoPhase(t)
+	ctx := context.Background()
+
+	// A coordinator that crashed right after preparing, before anything was logged
+	gid, err := newGID(coord.gidPrefix())
+	require.NoError(t, err)
+	rt := sm.routing.Load()
+	err = prepareParticipants(ctx, rt, rt.shardID(keys[0]), gid, []Participant{rename(keys[0], "Prepared")})
+	require.NoError(t, err)
+
+	// A coordinator logging on another shard leaves it alone
+	other := NewTwoPhaseCoordinator(sm, (coord.logShard+1)%sm.NumShards())
+	_, err = other.Recover(ctx, 0)
+	require.NoError(t, err)
+	gids, err := preparedGIDs(ctx, sm.PrimaryQuerier(keys[0]), gid, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{gid}, gids)
+
+	resolved, err := coord.Recover(ctx, 0)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, resolved, 1)
+	assert.Equal(t, "Before", nameOf(t, sm, keys[0]))
+}
@@ -0,0 +1,397 @@
+package sharding
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// UniqueViolationError is returned when a value is already reserved by another owner
+type UniqueViolationError struct {
+	Scope string
+	Value string
+	Owner string
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("%s already in use: %s", e.Scope, e.Value)
+}
+
+func (e *UniqueViolationError) Is(target error) bool { return target == ErrAlreadyExists }
+
+// UniqueIndex enforces cluster-wide uniqueness of one column's values
+// A shard's UNIQUE constraint only covers its own rows, so every value is first
+// reserved in the unique_reservations table of the shard that owns the value's
+// hash. A reservation is owned by the shard key of the row using the value.
+// The index doubles as a global secondary index from value to owner (see Lookup),
+// which is how the user repository finds a user by email.
+//
+// Reserving and releasing run in their own fenced transactions on the value's
+// shard, separate from the owning row's write. If a process dies in between,
+// the reservation is orphaned until Cleanup removes it.
+type UniqueIndex struct {
+	sm    *ShardManager
+	scope string
+}
+
+// NewUniqueIndex creates a unique index; scope names the column, e.g. "email"
+func NewUniqueIndex(sm *ShardManager, scope string) *UniqueIndex {
+	return &UniqueIndex{sm: sm, scope: scope}
+}
+
+// Reservation is one reserved value
+type Reservation struct {
+	Value string
+	Owner string
+}
+
+// ReserveResult is the outcome of reserving one value
+type ReserveResult struct {
+	// Acquired is false when the owner already held the value
+	// Only acquired reservations should be released when the owner's write fails
+	Acquired bool
+	Err      error
+}
+
+// Reserve reserves value for owner
+// Reserving a value the owner already holds succeeds with acquired false.
+// A value held by another owner fails with a *UniqueViolationError.
+func (u *UniqueIndex) Reserve(ctx context.Context, value, owner string) (acquired bool, err error) {
+	res := u.ReserveMany(ctx, []Reservation{{Value: value, Owner: owner}})
+	return res[0].Acquired, res[0].Err
+}
+
+// ReserveMany reserves many values with one statement per shard
+// Results are returned in input order. When the same value appears twice,
+// the first occurrence decides and later ones never count as acquired.
+func (u *UniqueIndex) ReserveMany(ctx context.Context, reservations []Reservation) []ReserveResult {
+	results := make([]ReserveResult, len(reservations))
+
+	groups := make(map[int][]int)
+	first := make(map[string]int)
+	var dups []int
+	for i, r := range reservations {
+		if _, ok := first[r.Value]; ok {
+			dups = append(dups, i)
+			continue
+		}
+		first[r.Value] = i
+		shardID := u.sm.GetShardID(r.Value)
+		groups[shardID] = append(groups[shardID], i)
+	}
+
+	var shards []*Shard
+	for shardID, indexes := range groups {
+		shard, err := u.sm.GetShardByID(shardID)
+		if err != nil {
+			for _, i := range indexes {
+				results[i].Err = err
+			}
+			continue
+		}
+		shards = append(shards, shard)
+	}
+
+	// Every shard writes only to its own items' results, so no locking is needed
+	fanned, _ := FanOut(ctx, shards, FanOutOptions{Policy: BestEffort}, func(ctx context.Context, shard *Shard) (struct{}, error) {
+		u.reserveShard(ctx, reservations, groups[shard.ShardID], results)
+		return struct{}{}, nil
+	})
+
+	// A shard skipped because ctx was done never ran, so its items fail here
+	for shardID, err := range fanned.Failed() {
+		for _, i := range groups[shardID] {
+			if results[i].Err == nil {
+				results[i].Err = err
+			}
+		}
+	}
+
+	for _, i := range dups {
+		j := first[reservations[i].Value]
+		switch {
+		case results[j].Err != nil:
+			results[i].Err = results[j].Err
+		case reservations[j].Owner != reservations[i].Owner:
+			results[i].Err = &UniqueViolationError{Scope: u.scope, Value: reservations[i].Value, Owner: reservations[j].Owner}
+		}
+	}
+
+	return results
+}
+
+// reserveShard reserves the values at the given indexes, which all route to one shard
+func (u *UniqueIndex) reserveShard(ctx context.Context, reservations []Reservation, indexes []int, results []ReserveResult) {
+	// Re-reserving by the same owner refreshes reserved_at, so Cleanup can't remove
+	// a reservation that was just confirmed; xmax is 0 only for freshly inserted rows
+	insert := `
+		INSERT INTO unique_reservations (scope, value, owner, reserved_at)
+		SELECT $1, value, owner, CURRENT_TIMESTAMP
+		FROM unnest($2::text[], $3::text[]) AS r(value, owner)
+		ON CONFLICT (scope, value) DO UPDATE SET reserved_at = CURRENT_TIMESTAMP
+		WHERE unique_reservations.owner = EXCLUDED.owner
+		RETURNING value, (xmax = 0) AS acquired
+	`
+	holders := `SELECT value, owner FROM unique_reservations WHERE scope = $1 AND value = ANY($2)`
+
+	var values, owners []string
+	for _, i := range indexes {
+		values = append(values, reservations[i].Value)
+		owners = append(owners, reservations[i].Owner)
+	}
+
+	var acquired map[string]bool
+	var taken map[string]string
+	err := u.sm.WithWriteTx(ctx, values[0], func(tx *ShardTx) error {
+		acquired = make(map[string]bool)
+		taken = make(map[string]string)
+
+		for _, value := range values {
+			// The topology may have moved values since they were grouped
+			if err := tx.CheckKey(value); err != nil {
+				return err
+			}
+		}
+
+		rows, err := tx.Query(ctx, insert, u.scope, values, owners)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var value string
+			var ok bool
+			if err := rows.Scan(&value, &ok); err != nil {
+				rows.Close()
+				return err
+			}
+			acquired[value] = ok
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Values missing from RETURNING are held by someone else
+		var conflicts []string
+		for _, value := range values {
+			if _, ok := acquired[value]; !ok {
+				conflicts = append(conflicts, value)
+			}
+		}
+		if len(conflicts) == 0 {
+			return nil
+		}
+
+		rows, err = tx.Query(ctx, holders, u.scope, conflicts)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var value, owner string
+			if err := rows.Scan(&value, &owner); err != nil {
+				return err
+			}
+			taken[value] = owner
+		}
+		return rows.Err()
+	})
+
+	for _, i := range indexes {
+		value := reservations[i].Value
+		switch {
+		case err != nil:
+			results[i].Err = fmt.Errorf("failed to reserve %s %s: %w", u.scope, value, err)
+		case taken[value] != "":
+			results[i].Err = &UniqueViolationError{Scope: u.scope, Value: value, Owner: taken[value]}
+		default:
+			results[i].Acquired = acquired[value]
+		}
+	}
+}
+
+// Release removes owner's reservation of value
+// Releasing a value the owner doesn't hold is a no-op.
+func (u *UniqueIndex) Release(ctx context.Context, value, owner string) error {
+	query := `DELETE FROM unique_reservations WHERE scope = $1 AND value = $2 AND owner = $3`
+
+	err := u.sm.WithWriteTx(ctx, value, func(tx *ShardTx) error {
+		_, err := tx.Exec(ctx, query, u.scope, value, owner)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release %s %s: %w", u.scope, value, err)
+	}
+
+	return nil
+}
+
+// Cleanup removes orphaned reservations and returns how many it removed
+// Only reservations older than minAge are considered, which leaves in-flight
+// writes alone. inUse is called with a batch of them and reports which are
+// still backed by their owner's row. A reservation refreshed by Reserve
+// while the cleanup runs is kept.
+func (u *UniqueIndex) Cleanup(ctx context.Context, minAge time.Duration, inUse func(ctx context.Context, rs []Reservation) ([]bool, error)) (int, error) {
+	remove := `
+		DELETE FROM unique_reservations
+		WHERE scope = $1 AND value = $2 AND owner = $3
+		  AND reserved_at < CURRENT_TIMESTAMP - make_interval(secs => $4)
+	`
+
+	orphans, err := u.Orphans(ctx, minAge, inUse)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, r := range orphans {
+		var n int64
+		err := u.sm.WithWriteTx(ctx, r.Value, func(tx *ShardTx) error {
+			var err error
+			n, err = tx.Exec(ctx, remove, u.scope, r.Value, r.Owner, minAge.Seconds())
+			return err
+		})
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove reservation of %s %s: %w", u.scope, r.Value, err)
+		}
+		removed += int(n)
+	}
+
+	return removed, nil
+}
+
+// Orphans returns the reservations older than minAge that inUse reports as unused
+// It is the read-only part of Cleanup.
+func (u *UniqueIndex) Orphans(ctx context.Context, minAge time.Duration, inUse func(ctx context.Context, rs []Reservation) ([]bool, error)) ([]Reservation, error) {
+	list := `
+		SELECT value, owner
+		FROM unique_reservations
+		WHERE scope = $1 AND reserved_at < CURRENT_TIMESTAMP - make_interval(secs => $2)
+	`
+
+	var orphans []Reservation
+	for _, shard := range u.sm.GetAllShards() {
+		// List on the primary: a lagging replica could return reservations already released
+		rows, err := shard.PrimaryQuerier().Query(ctx, list, u.scope, minAge.Seconds())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list reservations on shard %d: %w", shard.ShardID, err)
+		}
+
+		var stale []Reservation
+		for rows.Next() {
+			var r Reservation
+			if err := rows.Scan(&r.Value, &r.Owner); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan reservation from shard %d: %w", shard.ShardID, err)
+			}
+			stale = append(stale, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating reservations from shard %d: %w", shard.ShardID, err)
+		}
+		if len(stale) == 0 {
+			continue
+		}
+
+		used, err := inUse(ctx, stale)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify reservations on shard %d: %w", shard.ShardID, err)
+		}
+
+		for i, r := range stale {
+			if !used[i] {
+				orphans = append(orphans, r)
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// Lookup returns the owner of value, read from a replica of the value's shard
+func (u *UniqueIndex) Lookup(ctx context.Context, value string) (owner string, found bool, err error) {
+	query := `SELECT owner FROM unique_reservations WHERE scope = $1 AND value = $2`
+
+	shard, err := u.sm.GetShardByID(u.sm.GetShardID(value))
+	if err != nil {
+		return "", false, err
+	}
+
+	err = shard.ReplicaQuerier().QueryRow(ctx, query, u.scope, value).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to look up %s %s on shard %d: %w", u.scope, value, shard.ShardID, err)
+	}
+
+	return owner, true, nil
+}
+
+// Owners returns the owners of the given values, read from the primaries
+// Values without a reservation are absent from the map.
+func (u *UniqueIndex) Owners(ctx context.Context, values []string) (map[string]string, error) {
+	query := `SELECT value, owner FROM unique_reservations WHERE scope = $1 AND value = ANY($2)`
+
+	groups := make(map[int][]string)
+	for _, value := range values {
+		shardID := u.sm.GetShardID(value)
+		groups[shardID] = append(groups[shardID], value)
+	}
+
+	owners := make(map[string]string, len(values))
+	for shardID, group := range groups {
+		shard, err := u.sm.GetShardByID(shardID)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := shard.PrimaryQuerier().Query(ctx, query, u.scope, group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query reservations on shard %d: %w", shardID, err)
+		}
+
+		for rows.Next() {
+			var value, owner string
+			if err := rows.Scan(&value, &owner); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan reservation from shard %d: %w", shardID, err)
+			}
+			owners[value] = owner
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating reservations from shard %d: %w", shardID, err)
+		}
+	}
+
+	return owners, nil
+}
+
+// RunCleanup calls Cleanup every interval until ctx is cancelled
+// Failures are logged and retried on the next tick.
+func (u *UniqueIndex) RunCleanup(ctx context.Context, interval, minAge time.Duration, inUse func(ctx context.Context, rs []Reservation) ([]bool, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := u.Cleanup(ctx, minAge, inUse)
+		if err != nil {
+			log.Printf("%s reservation cleanup failed: %v", u.scope, err)
+			continue
+		}
+		if removed > 0 {
+			log.Printf("removed %d orphaned %s reservations", removed, u.scope)
+		}
+	}
+}